@@ -1,15 +1,13 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	openai "github.com/sashabaranov/go-openai"
 )
 
 type CombinedInput struct {
@@ -18,46 +16,78 @@ type CombinedInput struct {
 }
 
 func SubmitDataAndRecommend(c *gin.Context) {
+	input, recommendation, ok := saveDataSubmission(c)
+	if !ok {
+		return
+	}
+
+	// Call the recommend function with the complete recommendation, passing all of
+	// today's meals (newest first) so the daily glycemic load is in the context
+	recommend(c, textRecommendationPrompt, todaysMeals(input.Diet), []GlucoseReading{input.Glucose}, recommendation)
+}
+
+// StreamDataAndRecommend is SubmitDataAndRecommend streaming the
+// recommendation as Server-Sent Events
+func StreamDataAndRecommend(c *gin.Context) {
+	input, recommendation, ok := saveDataSubmission(c)
+	if !ok {
+		return
+	}
+
+	saved := gin.H{"glucose": input.Glucose, "diet": input.Diet}
+	streamRecommendation(c, textRecommendationPrompt, saved, todaysMeals(input.Diet), []GlucoseReading{input.Glucose}, recommendation)
+}
+
+// saveDataSubmission stores the submitted reading and meal and builds the
+// rule-based recommendation. It writes the error response when it fails.
+func saveDataSubmission(c *gin.Context) (CombinedInput, string, bool) {
 	userID, exists := c.Get("user_id")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+		return CombinedInput{}, "", false
 	}
 
 	var input CombinedInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input format", "details": err.Error()})
-		return
+		return input, "", false
 	}
 
 	// Save Glucose
+	input.Glucose.ID = 0
 	input.Glucose.UserID = userID.(uint)
 	input.Glucose.RecordedAt = time.Now()
 	if err := DB.Create(&input.Glucose).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save glucose data"})
-		return
+		return input, "", false
 	}
 
 	// Save Diet
+	resetDietLogIDs(&input.Diet)
 	input.Diet.UserID = userID.(uint)
 	input.Diet.Timestamp = time.Now()
+	applyGlycemicLoad(&input.Diet)
 	if err := DB.Create(&input.Diet).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet data"})
-		return
+		return input, "", false
 	}
 
 	// Get predefined glucose levels from the medical profile
 	var medicalProfile MedicalProfile
 	if err := DB.Where("user_id = ?", userID.(uint)).First(&medicalProfile).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve medical profile"})
-		return
+		return input, "", false
 	}
 
 	// Generate a single recommendation based on glucose level and compare with predefined levels
 	recommendation := generateCompleteRecommendation(input.Glucose, input.Diet, medicalProfile)
+	loc, err := requestLocation(c)
+	if err != nil {
+		loc = time.UTC
+	}
+	recommendation += recentAlcoholWarning(userID.(uint), loc)
 
-	// Call the recommend function with the complete recommendation
-	recommend(c, []DietLog{input.Diet}, []GlucoseReading{input.Glucose}, recommendation)
+	return input, recommendation, true
 }
 
 func generateCompleteRecommendation(glucose GlucoseReading, diet DietLog, medicalProfile MedicalProfile) string {
@@ -86,66 +116,318 @@ func generateCompleteRecommendation(glucose GlucoseReading, diet DietLog, medica
 	return recommendation
 }
 
-func recommend(c *gin.Context, diets []DietLog, glucose []GlucoseReading, recommendation string) {
-	prompt := buildPrompt(diets, glucose, recommendation) // Pass recommendation to the prompt
-	fmt.Println("Prompt being sent to OpenAI:\n", prompt)
+// recommend asks the LLM for a structured recommendation using the named
+// prompt template and responds with it and its text version. The rule-based
+// recommendation is returned instead when the LLM fails or is disabled,
+// marked by source. When the user has used up today's AI quota it is
+// returned with a 429 and the quota fields.
+func recommend(c *gin.Context, promptName string, diets []DietLog, glucose []GlucoseReading, recommendation string) {
+	record := newRecommendationOrFallback(c, promptName, diets, glucose, recommendation)
+	cached, exceeded := prepareRecommendation(&record)
+	structured := generateRecommendation(c, &record, cached, exceeded, diets, glucose, nil)
+	body := gin.H{"recommendation": record.Output, "structured": structured, "recommendation_id": record.ID, "cached": cached != nil, "source": record.Source}
+	if exceeded != nil {
+		writeAIQuotaExceeded(c, exceeded, body)
+		return
+	}
+	c.JSON(200, body)
+}
 
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	resp, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-		Model:       "gpt-3.5-turbo",
-		Temperature: 0.7,
-		Messages: []openai.ChatCompletionMessage{
+// streamRecommendation sends the saved records as a "saved" event right away,
+// then the recommendation a section at a time while the model writes it: a
+// "guidance" event for severe readings, then "assessment", "severity",
+// "meal", "activity" and "follow_up" events as each is complete. A "reset"
+// event means the sections sent so far are discarded, because the model's
+// output failed validation and is retried or the rule-based recommendation
+// replaces it. A "done" event carries the stored recommendation ID, the
+// validated structured fields, the text version and the source. When the
+// user has used up today's AI quota nothing is streamed: the response is a
+// 429 with the quota fields, the saved records and the rule-based
+// recommendation.
+func streamRecommendation(c *gin.Context, promptName string, saved gin.H, diets []DietLog, glucose []GlucoseReading, recommendation string) {
+	record := newRecommendationOrFallback(c, promptName, diets, glucose, recommendation)
+	cached, exceeded := prepareRecommendation(&record)
+	if exceeded != nil {
+		structured := generateRecommendation(c, &record, nil, exceeded, diets, glucose, nil)
+		writeAIQuotaExceeded(c, exceeded, gin.H{"saved": saved, "recommendation_id": record.ID, "recommendation": record.Output,
+			"structured": structured, "cached": false, "source": record.Source})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // keep proxies from buffering the stream
+	send := func(event string, data any) {
+		c.SSEvent(event, data)
+		c.Writer.Flush()
+	}
+	send("saved", saved)
+
+	// Sections are checked by their own guardrail while they stream; the
+	// stored recommendation is checked again as a whole
+	preview := newGuardrail(glucose)
+	if guidance := strings.TrimSpace(preview.prefix()); guidance != "" {
+		send("guidance", gin.H{"content": guidance})
+	}
+	streamedAttempt := -1
+	onSection := func(attempt int, key string, raw json.RawMessage) {
+		if attempt != streamedAttempt {
+			if streamedAttempt >= 0 {
+				send("reset", gin.H{"reason": "The recommendation is being regenerated"})
+			}
+			streamedAttempt = attempt
+		}
+		if event, data, ok := previewSection(preview, key, raw); ok {
+			send(event, data)
+		}
+	}
+
+	structured := generateRecommendation(c, &record, cached, nil, diets, glucose, onSection)
+	if cached != nil || record.Source != recommendationSourceAI || streamedAttempt < 0 {
+		// Cached and rule-based recommendations are complete already
+		if streamedAttempt >= 0 {
+			send("reset", gin.H{"reason": "The recommendation was replaced"})
+		}
+		sendSections(send, structured)
+	}
+	send("done", gin.H{"recommendation_id": record.ID, "recommendation": record.Output, "structured": structured, "cached": cached != nil, "source": record.Source})
+}
+
+// previewSection turns a streamed section of the model's output into the
+// event sent for it, filtered by the guardrail. Sections that don't decode or
+// are left empty are skipped.
+func previewSection(g *guardrail, key string, raw json.RawMessage) (string, any, bool) {
+	clean := func(text string) string {
+		return strings.TrimSpace(g.filter(text))
+	}
+	switch key {
+	case "assessment", "follow_up":
+		var text string
+		if json.Unmarshal(raw, &text) != nil || clean(text) == "" {
+			return "", nil, false
+		}
+		return key, gin.H{"content": clean(text)}, true
+	case "severity":
+		var severity string
+		if json.Unmarshal(raw, &severity) != nil {
+			return "", nil, false
+		}
+		severity = strings.ToLower(strings.TrimSpace(severity))
+		if g.severeLow || g.severeHigh {
+			severity = "urgent"
+		}
+		if !recommendationSeverities[severity] {
+			return "", nil, false
+		}
+		return "severity", gin.H{"severity": severity}, true
+	case "meals":
+		var meal SuggestedMeal
+		if json.Unmarshal(raw, &meal) != nil {
+			return "", nil, false
+		}
+		meal.Name, meal.Reasoning = clean(meal.Name), clean(meal.Reasoning)
+		return "meal", meal, meal.Name != ""
+	case "activities":
+		var activity SuggestedActivity
+		if json.Unmarshal(raw, &activity) != nil {
+			return "", nil, false
+		}
+		activity.Type, activity.Timing = clean(activity.Type), clean(activity.Timing)
+		return "activity", activity, activity.Type != ""
+	}
+	return "", nil, false
+}
+
+// sendSections sends a complete recommendation as the events it would have
+// been streamed as
+func sendSections(send func(event string, data any), structured StructuredRecommendation) {
+	send("assessment", gin.H{"content": structured.Assessment})
+	send("severity", gin.H{"severity": structured.Severity})
+	for _, meal := range structured.Meals {
+		send("meal", meal)
+	}
+	for _, activity := range structured.Activities {
+		send("activity", activity)
+	}
+	for _, check := range structured.FollowUp {
+		send("follow_up", gin.H{"content": check})
+	}
+}
+
+// newRecommendationOrFallback builds the record for the LLM, or for the
+// rule-based recommendation when the prompt can't be built
+func newRecommendationOrFallback(c *gin.Context, promptName string, diets []DietLog, glucose []GlucoseReading, recommendation string) Recommendation {
+	record, err := newRecommendation(c, promptName, diets, glucose, recommendation)
+	if err != nil {
+		fmt.Println("Error building prompt:", err)
+		record.Source, record.Error = recommendationSourceRules, err.Error()
+	}
+	return record
+}
+
+// prepareRecommendation looks for a recent recommendation for the same input
+// to reuse, or else reserves an AI request for the record, before anything is
+// sent. When the user has used up today's AI quota the record switches to the
+// rule-based recommendation and the exceeded quota is returned.
+func prepareRecommendation(record *Recommendation) (*Recommendation, *AIQuotaExceeded) {
+	if !aiRecommendationsEnabled() {
+		record.Source = recommendationSourceRules
+	}
+	if record.Source == recommendationSourceRules {
+		return nil, nil
+	}
+	if cached, ok := cachedRecommendation(*record); ok {
+		return &cached, nil
+	}
+	exceeded, err := reserveAIRequest(record.UserID)
+	if err != nil {
+		fmt.Println("Error reserving AI usage:", err)
+	}
+	if exceeded != nil {
+		record.Source = recommendationSourceRules
+		record.Error = fmt.Sprintf("daily AI %s limit reached", exceeded.Limit)
+	}
+	return nil, exceeded
+}
+
+// generateRecommendation gets the structured recommendation, applies the
+// safety guardrails and stores the record with any guardrail violations. The
+// cached recommendation found by prepareRecommendation is reused instead; the
+// record still gets its own row for this submission. When the LLM fails, is
+// disabled or the quota is exceeded the rule-based recommendation is used,
+// keeping the reason in the record. onSection, when set, streams the model's
+// output as described for generate.
+func generateRecommendation(c *gin.Context, record *Recommendation, cached *Recommendation, exceeded *AIQuotaExceeded, diets []DietLog, glucose []GlucoseReading, onSection func(attempt int, key string, raw json.RawMessage)) StructuredRecommendation {
+	if cached != nil {
+		reuseRecommendation(record, *cached)
+		if err := DB.Create(record).Error; err != nil {
+			fmt.Println("Error saving recommendation:", err)
+		}
+		return *record.Structured
+	}
+
+	guard := newGuardrail(glucose)
+	var structured StructuredRecommendation
+	if record.Source != recommendationSourceRules {
+		ctx, cancel := aiRequestContext(c)
+		defer cancel()
+		var err error
+		structured, err = record.generate(ctx, onSection)
+		recordAIUsage(record.UserID, record.PromptTokens, record.CompletionTokens)
+		record.Source = recommendationSourceAI
+		if err != nil {
+			fmt.Println("LLM error, using the rule-based recommendation:", err)
+			record.Source = recommendationSourceRules
+		}
+	}
+	if record.Source == recommendationSourceRules {
+		var profile MedicalProfile
+		DB.Where("user_id = ?", record.UserID).First(&profile)
+		structured = ruleBasedRecommendation(record.RuleRecommendation, profile, diets, glucose, time.Now())
+	}
+
+	structured = guard.applyStructured(structured)
+	if exceeded != nil {
+		notice := fmt.Sprintf("You have reached today's AI %s limit, so this recommendation was built from your data by simple rules. "+
+			"AI recommendations are available again after %s UTC.", exceeded.Limit, exceeded.ResetsAt.Format("15:04"))
+		structured.Notices = append([]string{notice}, structured.Notices...)
+	}
+	record.Structured = &structured
+	record.Output = renderRecommendation(structured)
+	if saveErr := DB.Create(record).Error; saveErr != nil {
+		fmt.Println("Error saving recommendation:", saveErr)
+	}
+	saveGuardrailViolations(*record, guard.violations)
+	return structured
+}
+
+func recommendationRequest(system, prompt string) LLMRequest {
+	return LLMRequest{
+		JSON: true,
+		Messages: []LLMMessage{
 			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: "You are a helpful nutritionist for people with diabetes, using the most advanced medical knowledge available. Your job is to recommend appropriate meals for the rest of the day based on the user's glucose levels and previous food intake. Always acknowledge the food in the user's uploaded image at the beginning of your response (e.g., 'I see you had [food] for your meal'). Also suggest suitable workouts to help maintain optimal glucose control. Present your recommendations in a clear, well-formatted manner.",
+				Role:    "system",
+				Content: system,
 			},
 			{
-				Role:    openai.ChatMessageRoleUser,
+				Role:    "user",
 				Content: prompt,
 			},
 		},
-	})
-
-	if err != nil {
-		fmt.Println("OpenAI error:", err)
-		c.JSON(500, gin.H{"error": "Failed to get recommendation from AI"})
-		return
 	}
-
-	c.JSON(200, gin.H{"recommendation": resp.Choices[0].Message.Content})
 }
 
-func buildPrompt(diets []DietLog, glucose []GlucoseReading, recommendation string) string {
+// buildPromptVars lays out the user's data for the prompt templates.
+// Everything the user typed or the classifier produced is cleaned by
+// sanitizer and kept inside the user data block.
+func buildPromptVars(diets []DietLog, glucose []GlucoseReading, recommendation string, patientContext string, sanitizer *promptSanitizer) promptVars {
 	var sb strings.Builder
 
+	sb.WriteString(userDataOpen + "\n")
+	if patientContext != "" {
+		sb.WriteString("Background on the user:\n")
+		sb.WriteString(patientContext)
+		sb.WriteString("\n")
+	}
+
 	sb.WriteString("Here is the recent glucose and diet log for a user with diabetes:\n\n")
 
 	// Include glucose readings and diet logs
 	if len(glucose) > 0 {
 		sb.WriteString("Recent Glucose Readings:\n")
 		for _, g := range glucose {
-			sb.WriteString(fmt.Sprintf("- %s: %.1f mg/dL (%s)\n", g.RecordedAt.Format("Jan 2 15:04"), g.Level, g.MealTag))
+			sb.WriteString(fmt.Sprintf("- %s: %.1f mg/dL (%s)\n", g.RecordedAt.Format("Jan 2 15:04"), g.Level,
+				sanitizer.clean("meal_tag", g.MealTag, maxPromptNameLength)))
+			if g.Notes != "" {
+				sb.WriteString("  Notes: " + sanitizer.clean("glucose_notes", g.Notes, maxPromptFieldLength) + "\n")
+			}
 		}
 	}
 
+	var foodName string
 	if len(diets) > 0 {
 		sb.WriteString("Recent Meals:\n")
+		var totalLoad float64
+		unknownLoads := 0
 		for _, d := range diets {
-			sb.WriteString(fmt.Sprintf("- %s: %s (%d cal) - %s\n", d.Timestamp.Format("Jan 2 15:04"), d.FoodDescription, d.Calories, d.Nutrients))
+			sb.WriteString(fmt.Sprintf("- %s: %s (%d cal) - %s\n", d.Timestamp.Format("Jan 2 15:04"),
+				sanitizer.clean("food_description", d.FoodDescription, maxPromptFieldLength), d.Calories,
+				sanitizer.clean("nutrients", d.Nutrients, maxPromptFieldLength)))
+			if glycemicLoadKnown(d) {
+				sb.WriteString(fmt.Sprintf("  Carbs: %.1f g, glycemic load: %.1f (%s)\n", d.Carbs, d.GlycemicLoad, glycemicLoadCategory(d.GlycemicLoad)))
+				totalLoad += d.GlycemicLoad
+				continue
+			}
+			unknownLoads++
+			if d.Carbs > 0 {
+				sb.WriteString(fmt.Sprintf("  Carbs: %.1f g, glycemic load unknown\n", d.Carbs))
+			}
+		}
+		if unknownLoads < len(diets) {
+			sb.WriteString(fmt.Sprintf("Total glycemic load of these meals: %.1f", totalLoad))
+			if unknownLoads > 0 {
+				sb.WriteString(fmt.Sprintf(" (partial, %d of %d meals unknown)", unknownLoads, len(diets)))
+			}
+			sb.WriteString("\n")
 		}
 
-		// Add explicit instruction to acknowledge the food in the response
-		if len(diets) > 0 && diets[0].FoodDescription != "" {
-			// Extract the food name (usually before the first colon or delimiter)
-			parts := strings.Split(diets[0].FoodDescription, ":")
-			foodName := strings.TrimSpace(parts[0])
-
-			sb.WriteString(fmt.Sprintf("\nIMPORTANT: The user has uploaded an image of %s. Please acknowledge this in your response by starting with 'I see that you had %s' or similar phrasing.\n", foodName, foodName))
+		if diets[0].FoodDescription != "" {
+			// Extract the food name (usually before the first colon or delimiter).
+			// The whole description is checked so an injection after the colon
+			// also drops the name.
+			if description := sanitizer.clean("food_name", diets[0].FoodDescription, maxPromptFieldLength); description != removedPromptText {
+				foodName = truncateRunes(strings.TrimSpace(strings.Split(description, ":")[0]), maxPromptNameLength)
+			}
 		}
 	}
 
-	sb.WriteString("\n\nHere is your recommendation:\n")
-	sb.WriteString(recommendation)
+	sb.WriteString("\nRule-based assessment:\n")
+	sb.WriteString(sanitizer.clean("rule_recommendation", recommendation, 4*maxPromptFieldLength))
+	sb.WriteString("\n" + userDataClose)
 
-	return sb.String()
+	return promptVars{
+		UserData:        sb.String(),
+		FoodName:        foodName,
+		DataInstruction: userDataInstruction,
+		OutputFormat:    recommendationOutputFormat,
+	}
 }
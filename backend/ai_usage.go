@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Daily limits used when AI_DAILY_REQUEST_LIMIT and AI_DAILY_TOKEN_LIMIT are
+// not set
+const (
+	defaultAIDailyRequests = 50
+	defaultAIDailyTokens   = 100000
+)
+
+// AIUsage is a user's LLM usage on one day (UTC)
+type AIUsage struct {
+	ID               uint      `gorm:"primaryKey" json:"-"`
+	UserID           uint      `gorm:"not null;uniqueIndex:idx_ai_usage_user_day" json:"user_id"`
+	Day              string    `gorm:"not null;uniqueIndex:idx_ai_usage_user_day" json:"day"` // YYYY-MM-DD
+	Requests         int       `json:"requests"`                                              // AI requests, reserved before the model is called
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"` // estimated, in USD
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// AIQuota is the daily limit of every user, zero means unlimited
+type AIQuota struct {
+	Requests int     `json:"requests"`
+	Tokens   int     `json:"tokens"`
+	Cost     float64 `json:"cost"` // USD
+}
+
+// aiQuota reads AI_DAILY_REQUEST_LIMIT, AI_DAILY_TOKEN_LIMIT and
+// AI_DAILY_COST_LIMIT. A limit of 0 disables it.
+func aiQuota() AIQuota {
+	quota := AIQuota{Requests: defaultAIDailyRequests, Tokens: defaultAIDailyTokens}
+	if v, err := strconv.Atoi(os.Getenv("AI_DAILY_REQUEST_LIMIT")); err == nil && v >= 0 {
+		quota.Requests = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AI_DAILY_TOKEN_LIMIT")); err == nil && v >= 0 {
+		quota.Tokens = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("AI_DAILY_COST_LIMIT"), 64); err == nil && v >= 0 {
+		quota.Cost = v
+	}
+	return quota
+}
+
+// aiUsageDay is the day usage is counted on
+func aiUsageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// recordAIUsage adds the tokens and cost of model calls to the user's usage
+// of today. The request itself was counted when it was reserved.
+func recordAIUsage(userID uint, promptTokens, completionTokens int) {
+	usage := AIUsage{
+		UserID:           userID,
+		Day:              aiUsageDay(time.Now()),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Cost: (float64(promptTokens)*llmConfig.PromptPrice +
+			float64(completionTokens)*llmConfig.CompletionPrice) / 1e6,
+	}
+	err := DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"prompt_tokens":     gorm.Expr("ai_usages.prompt_tokens + ?", usage.PromptTokens),
+			"completion_tokens": gorm.Expr("ai_usages.completion_tokens + ?", usage.CompletionTokens),
+			"cost":              gorm.Expr("ai_usages.cost + ?", usage.Cost),
+			"updated_at":        time.Now(),
+		}),
+	}).Create(&usage).Error
+	if err != nil {
+		fmt.Println("Error recording AI usage:", err)
+	}
+}
+
+// exceededAIQuota names the limit the usage has reached, or is empty
+func exceededAIQuota(usage AIUsage, quota AIQuota) string {
+	switch {
+	case quota.Requests > 0 && usage.Requests >= quota.Requests:
+		return "requests"
+	case quota.Tokens > 0 && usage.PromptTokens+usage.CompletionTokens >= quota.Tokens:
+		return "tokens"
+	case quota.Cost > 0 && usage.Cost >= quota.Cost:
+		return "cost"
+	}
+	return ""
+}
+
+// aiQuotaResetsAt is when today's usage stops counting
+func aiQuotaResetsAt(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// AIQuotaExceeded is a used-up daily quota as reported in 429 responses
+type AIQuotaExceeded struct {
+	Limit    string    `json:"limit"` // requests, tokens or cost
+	Usage    AIUsage   `json:"usage"`
+	Quota    AIQuota   `json:"quota"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// reserveAIRequest counts a request against the user's quota before the
+// model is called. The count is only incremented while every limit is below
+// its quota, in one statement, so concurrent requests can't all pass a check
+// of the same usage. When the quota is used up nothing is counted and the
+// exceeded quota is returned. Usage is only checked before a request, so the
+// calls of one request are never cut off halfway.
+func reserveAIRequest(userID uint) (*AIQuotaExceeded, error) {
+	quota := aiQuota()
+	now := time.Now()
+	usage := AIUsage{UserID: userID, Day: aiUsageDay(now), Requests: 1, UpdatedAt: now}
+	result := DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"requests":   gorm.Expr("ai_usages.requests + 1"),
+			"updated_at": now,
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("(? = 0 OR ai_usages.requests < ?)", quota.Requests, quota.Requests),
+			gorm.Expr("(? = 0 OR ai_usages.prompt_tokens + ai_usages.completion_tokens < ?)", quota.Tokens, quota.Tokens),
+			gorm.Expr("(? = 0 OR ai_usages.cost < ?)", quota.Cost, quota.Cost),
+		}},
+	}).Create(&usage)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil, nil
+	}
+
+	usage = AIUsage{}
+	if err := DB.Where("user_id = ? AND day = ?", userID, aiUsageDay(now)).First(&usage).Error; err != nil {
+		return nil, err
+	}
+	exceeded := &AIQuotaExceeded{Limit: exceededAIQuota(usage, quota), Usage: usage, Quota: quota, ResetsAt: aiQuotaResetsAt(now)}
+	if exceeded.Limit == "" {
+		// The quota changed between the two statements
+		exceeded.Limit = "requests"
+	}
+	return exceeded, nil
+}
+
+// writeAIQuotaExceeded writes the 429 response for a used-up quota. body
+// holds any further fields of the response.
+func writeAIQuotaExceeded(c *gin.Context, exceeded *AIQuotaExceeded, body gin.H) {
+	if body == nil {
+		body = gin.H{}
+	}
+	now := time.Now().UTC()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(exceeded.ResetsAt.Sub(now).Seconds()))))
+	body["error"] = fmt.Sprintf("Daily AI %s limit reached, please try again after %s UTC", exceeded.Limit, exceeded.ResetsAt.Format("15:04"))
+	body["quota_exceeded"] = true
+	body["limit"] = exceeded.Limit
+	body["usage"] = exceeded.Usage
+	body["quota"] = exceeded.Quota
+	body["resets_at"] = exceeded.ResetsAt
+	c.JSON(http.StatusTooManyRequests, body)
+}
+
+// reserveAIQuota reserves a request with reserveAIRequest, writing a 429
+// response and returning false when the user has used up today's quota. The
+// request is let through when the usage can't be read.
+func reserveAIQuota(c *gin.Context, userID uint) bool {
+	exceeded, err := reserveAIRequest(userID)
+	if err != nil {
+		fmt.Println("Error reserving AI usage:", err)
+		return true
+	}
+	if exceeded != nil {
+		writeAIQuotaExceeded(c, exceeded, nil)
+		return false
+	}
+	return true
+}
+
+// GET /ai-usage?days=30
+func GetAIUsage(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	days := 30
+	if v := c.Query("days"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 366 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+			return
+		}
+		days = parsed
+	}
+
+	now := time.Now()
+	var usage []AIUsage
+	if err := DB.Where("user_id = ? AND day > ?", userID.(uint), aiUsageDay(now.AddDate(0, 0, -days))).
+		Order("day desc").Find(&usage).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve AI usage"})
+		return
+	}
+
+	today := AIUsage{UserID: userID.(uint), Day: aiUsageDay(now)}
+	if len(usage) > 0 && usage[0].Day == today.Day {
+		today = usage[0]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"today":     today,
+		"quota":     aiQuota(),
+		"resets_at": aiQuotaResetsAt(now),
+		"usage":     usage,
+	})
+}
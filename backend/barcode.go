@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errInvalidBarcode = errors.New("invalid barcode")
+
+// FoodProduct is a packaged food imported from an Open Food Facts style dump.
+// Nutrient values are stored per 100 g (or 100 ml), as in the source data.
+type FoodProduct struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	Barcode           string    `gorm:"not null;uniqueIndex" json:"barcode"`
+	ProductName       string    `json:"product_name"`
+	Brands            string    `json:"brands"`
+	ServingSize       string    `json:"serving_size"`
+	ServingQuantity   float64   `json:"serving_quantity"` // grams (or ml) per serving
+	EnergyKcal100g    float64   `gorm:"column:energy_kcal_100g" json:"energy_kcal_100g"`
+	Carbohydrates100g float64   `gorm:"column:carbohydrates_100g" json:"carbohydrates_100g"`
+	Sugars100g        float64   `gorm:"column:sugars_100g" json:"sugars_100g"`
+	Fiber100g         float64   `gorm:"column:fiber_100g" json:"fiber_100g"`
+	Proteins100g      float64   `gorm:"column:proteins_100g" json:"proteins_100g"`
+	Fat100g           float64   `gorm:"column:fat_100g" json:"fat_100g"`
+	SaturatedFat100g  float64   `gorm:"column:saturated_fat_100g" json:"saturated_fat_100g"`
+	Sodium100g        float64   `gorm:"column:sodium_100g" json:"sodium_100g"` // grams, as in the dump
+	SourceModifiedAt  time.Time `json:"source_modified_at"`                    // last_modified_t from the dump
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// ServingNutrition is the nutrition of one serving of a FoodProduct
+type ServingNutrition struct {
+	ServingSize     string  `json:"serving_size"`
+	ServingQuantity float64 `json:"serving_quantity"`
+	Calories        float64 `json:"calories"`
+	Carbohydrates   float64 `json:"carbohydrates"`
+	Sugar           float64 `json:"sugar"`
+	Fiber           float64 `json:"fiber"`
+	Protein         float64 `json:"protein"`
+	Fat             float64 `json:"fat"`
+	SaturatedFat    float64 `json:"saturated_fat"`
+	Sodium          float64 `json:"sodium"` // mg, to match the classifier nutrients
+}
+
+// PerServing scales the per-100 g values to one serving. Products without a
+// known serving quantity are reported per 100 g.
+func (p FoodProduct) PerServing() ServingNutrition {
+	quantity := p.ServingQuantity
+	size := p.ServingSize
+	if quantity <= 0 {
+		quantity = 100
+		size = "100 g"
+	}
+	factor := quantity / 100
+
+	return ServingNutrition{
+		ServingSize:     size,
+		ServingQuantity: quantity,
+		Calories:        round1(p.EnergyKcal100g * factor),
+		Carbohydrates:   round1(p.Carbohydrates100g * factor),
+		Sugar:           round1(p.Sugars100g * factor),
+		Fiber:           round1(p.Fiber100g * factor),
+		Protein:         round1(p.Proteins100g * factor),
+		Fat:             round1(p.Fat100g * factor),
+		SaturatedFat:    round1(p.SaturatedFat100g * factor),
+		Sodium:          round1(p.Sodium100g * 1000 * factor),
+	}
+}
+
+// DisplayName combines the brand and product name for diet log descriptions
+func (p FoodProduct) DisplayName() string {
+	name := p.ProductName
+	if name == "" {
+		name = "Product " + p.Barcode
+	}
+	if p.Brands != "" {
+		// Dumps list several brands separated by commas, the first is the main one
+		brand := strings.TrimSpace(strings.Split(p.Brands, ",")[0])
+		name = brand + " " + name
+	}
+	return name
+}
+
+// GET /foods/barcode/:ean
+func GetFoodByBarcode(c *gin.Context) {
+	product, err := findProductByBarcode(c.Param("ean"))
+	if err != nil {
+		writeProductLookupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product":     product,
+		"per_serving": product.PerServing(),
+	})
+}
+
+// POST /foods/barcode/:ean creates a diet log entry for the scanned product
+func LogFoodByBarcode(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Servings float64 `json:"servings"`
+	}
+	// The body is optional, an empty request logs a single serving
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if input.Servings < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Servings must be positive"})
+		return
+	}
+	if input.Servings == 0 {
+		input.Servings = 1
+	}
+
+	product, err := findProductByBarcode(c.Param("ean"))
+	if err != nil {
+		writeProductLookupError(c, err)
+		return
+	}
+
+	serving := product.PerServing()
+	nutrients := map[string]float64{
+		"carbohydrates": round1(serving.Carbohydrates * input.Servings),
+		"sugar":         round1(serving.Sugar * input.Servings),
+		"fiber":         round1(serving.Fiber * input.Servings),
+		"protein":       round1(serving.Protein * input.Servings),
+		"fat":           round1(serving.Fat * input.Servings),
+		"saturated_fat": round1(serving.SaturatedFat * input.Servings),
+		"sodium":        round1(serving.Sodium * input.Servings),
+	}
+	nutrientsJSON, err := json.Marshal(nutrients)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process nutrients data"})
+		return
+	}
+
+	dietLog := DietLog{
+		UserID:          userID.(uint),
+		Timestamp:       time.Now(),
+		FoodDescription: fmt.Sprintf("%s (%g x %s)", product.DisplayName(), input.Servings, serving.ServingSize),
+		Calories:        uint(math.Round(serving.Calories * input.Servings)),
+		Nutrients:       string(nutrientsJSON),
+		Items: []DietLogItem{{
+			FoodName: product.DisplayName(),
+			Portion:  serving.ServingSize,
+			Quantity: input.Servings,
+			Calories: uint(math.Round(serving.Calories)),
+			Carbs:    serving.Carbohydrates,
+			Fiber:    serving.Fiber,
+		}},
+	}
+	applyGlycemicLoad(&dietLog)
+
+	if err := DB.Create(&dietLog).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Diet log saved",
+		"product":     product,
+		"per_serving": serving,
+		"diet_log":    dietLog,
+	})
+}
+
+// findProductByBarcode looks a product up by EAN/UPC. Scanners and dumps
+// disagree on leading zeros (UPC-A vs EAN-13), so both forms are tried.
+func findProductByBarcode(ean string) (FoodProduct, error) {
+	code := normalizeBarcode(ean)
+	if code == "" {
+		return FoodProduct{}, errInvalidBarcode
+	}
+
+	candidates := []string{code}
+	if trimmed := strings.TrimLeft(code, "0"); trimmed != code && trimmed != "" {
+		candidates = append(candidates, trimmed)
+	}
+	if len(code) < 13 {
+		candidates = append(candidates, strings.Repeat("0", 13-len(code))+code)
+	}
+
+	var product FoodProduct
+	err := DB.Where("barcode IN ?", candidates).First(&product).Error
+	return product, err
+}
+
+// writeProductLookupError writes the response for a failed
+// findProductByBarcode
+func writeProductLookupError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInvalidBarcode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid barcode"})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up product"})
+	}
+}
+
+// normalizeBarcode strips everything but digits from a scanned code
+func normalizeBarcode(code string) string {
+	var sb strings.Builder
+	for _, r := range code {
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// round1 rounds to one decimal place for display
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// Longest chat message accepted from the user, in characters
+	maxChatMessageLength = 2000
+	// Longest summary of earlier turns kept on a thread, in characters
+	maxChatSummaryLength = 1500
+	// At most this many recent messages are sent in full, older ones are summarised
+	chatRecentMessages = 20
+	// Used when CHAT_HISTORY_TOKENS is not set
+	defaultChatHistoryTokens = 2000
+	// Meals listed individually with every turn
+	chatLatestMeals = 5
+	// A reading this recent decides the reading-based guardrails of a reply
+	chatReadingWindow = 3 * time.Hour
+)
+
+// ChatThread is a conversation of a user with the assistant
+type ChatThread struct {
+	ID                  uint          `gorm:"primaryKey" json:"id"`
+	UserID              uint          `gorm:"not null;index" json:"user_id"`
+	Title               string        `json:"title"`
+	Summary             string        `json:"summary"` // summary of the turns no longer sent in full
+	SummarizedThroughID uint          `json:"-"`       // last message included in Summary
+	Messages            []ChatMessage `gorm:"foreignKey:ThreadID;constraint:OnDelete:CASCADE" json:"messages,omitempty"`
+	CreatedAt           time.Time     `json:"created_at"`
+	UpdatedAt           time.Time     `gorm:"index" json:"updated_at"`
+}
+
+// ChatMessage is one message of a thread
+type ChatMessage struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	ThreadID         uint      `gorm:"not null;index" json:"thread_id"`
+	Role             string    `gorm:"not null" json:"role"` // user or assistant
+	Content          string    `json:"content"`              // replies after the safety guardrails
+	RawContent       string    `json:"-"`                    // the model's unfiltered reply
+	Context          string    `json:"-"`                    // data block sent with the question
+	InjectionFlags   string    `json:"-"`
+	PromptVersion    string    `json:"-"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	LatencyMS        int64     `json:"latency_ms,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// chatTurn is a question with everything needed to answer it
+type chatTurn struct {
+	thread   ChatThread
+	question ChatMessage
+	reply    ChatMessage
+	request  LLMRequest
+	guard    *guardrail
+}
+
+// chatHistoryTokenBudget is the token budget of the earlier messages sent
+// with a question
+func chatHistoryTokenBudget() int {
+	if v, err := strconv.Atoi(os.Getenv("CHAT_HISTORY_TOKENS")); err == nil && v > 0 {
+		return v
+	}
+	return defaultChatHistoryTokens
+}
+
+// POST /chat/threads
+func CreateChatThread(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Title string `json:"title"` // defaults to the start of the first question
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	thread := ChatThread{UserID: userID.(uint), Title: truncateRunes(strings.TrimSpace(input.Title), maxPromptNameLength)}
+	if err := DB.Create(&thread).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat thread"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chat thread created", "thread": thread})
+}
+
+// GET /chat/threads
+func GetChatThreads(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var threads []ChatThread
+	if err := DB.Where("user_id = ?", userID.(uint)).Order("updated_at desc").Find(&threads).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat threads"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"threads": threads})
+}
+
+// GET /chat/threads/:id
+func GetChatThread(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var thread ChatThread
+	if err := DB.Preload("Messages", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&thread).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat thread not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"thread": thread, "disclaimer": medicalDisclaimer})
+}
+
+// DELETE /chat/threads/:id
+func DeleteChatThread(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&ChatThread{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat thread"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat thread not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chat thread deleted"})
+}
+
+// POST /chat/threads/:id/messages?tz=Area/City
+func SendChatMessage(c *gin.Context) {
+	ctx, cancel := aiRequestContext(c)
+	defer cancel()
+	turn, ok := prepareChatTurn(c, ctx)
+	if !ok {
+		return
+	}
+
+	started := time.Now()
+	resp, err := llm.Complete(ctx, turn.request)
+	if err != nil {
+		fmt.Println("LLM error:", err)
+		c.JSON(aiErrorStatus(err), gin.H{"error": "Failed to get a reply from AI"})
+		return
+	}
+	recordAIUsage(turn.thread.UserID, resp.PromptTokens, resp.CompletionTokens)
+	turn.complete(resp, turn.guard.apply(resp.Content), started)
+	if err := saveChatTurn(turn); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chat messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": turn.question, "reply": turn.reply})
+}
+
+// POST /chat/threads/:id/messages/stream sends the reply as "token" events
+// while it is generated, then a "done" event with the stored messages (or an
+// "error" event)
+func StreamChatMessage(c *gin.Context) {
+	ctx, cancel := aiRequestContext(c)
+	defer cancel()
+	turn, ok := prepareChatTurn(c, ctx)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // keep proxies from buffering the stream
+
+	// Text is released a sentence at a time so the guardrails can remove
+	// unsafe sentences before they are sent
+	var sent strings.Builder
+	send := func(text string) {
+		if text == "" {
+			return
+		}
+		sent.WriteString(text)
+		c.SSEvent("token", gin.H{"content": text})
+		c.Writer.Flush()
+	}
+	send(turn.guard.prefix())
+
+	var buffer sentenceBuffer
+	started := time.Now()
+	resp, err := llm.Stream(ctx, turn.request, func(delta string) error {
+		send(turn.guard.filter(buffer.add(delta)))
+		return ctx.Err()
+	})
+	if err != nil {
+		fmt.Println("LLM error:", err)
+		c.SSEvent("error", gin.H{"error": "Failed to get a reply from AI"})
+		c.Writer.Flush()
+		return
+	}
+	recordAIUsage(turn.thread.UserID, resp.PromptTokens, resp.CompletionTokens)
+	send(turn.guard.filter(buffer.flush()))
+	send(turn.guard.suffix())
+
+	turn.complete(resp, sent.String(), started)
+	if err := saveChatTurn(turn); err != nil {
+		c.SSEvent("error", gin.H{"error": "Failed to save chat messages"})
+		c.Writer.Flush()
+		return
+	}
+	c.SSEvent("done", gin.H{"message": turn.question, "reply": turn.reply})
+	c.Writer.Flush()
+}
+
+// prepareChatTurn reads the question and builds the request with the thread's
+// history and the user's latest data, summarizing older history within ctx. It
+// writes the error response when it fails.
+func prepareChatTurn(c *gin.Context, ctx context.Context) (*chatTurn, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	var input struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	input.Content = strings.TrimSpace(input.Content)
+	if input.Content == "" || utf8.RuneCountInString(input.Content) > maxChatMessageLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Message must be 1 to %d characters", maxChatMessageLength)})
+		return nil, false
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	turn := &chatTurn{}
+	if err := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&turn.thread).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat thread not found"})
+		return nil, false
+	}
+	if !reserveAIQuota(c, turn.thread.UserID) {
+		return nil, false
+	}
+
+	history, err := chatHistory(ctx, &turn.thread)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat messages"})
+		return nil, false
+	}
+
+	sanitizer := &promptSanitizer{}
+	vars := promptVars{
+		UserData:        chatUserData(turn.thread.UserID, turn.thread.Summary, loc, sanitizer),
+		DataInstruction: userDataInstruction,
+		Question:        sanitizer.inspect("chat_message", input.Content, maxChatMessageLength),
+	}
+	system, user, err := promptTemplates[chatPrompt][chatPromptVersion].render(vars)
+	if err != nil {
+		fmt.Println("Error building prompt:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get a reply from AI"})
+		return nil, false
+	}
+
+	turn.question = ChatMessage{ThreadID: turn.thread.ID, Role: "user", Content: input.Content, Context: vars.UserData}
+	if len(sanitizer.flags) > 0 {
+		turn.question.InjectionFlags = strings.Join(sanitizer.flags, "; ")
+		fmt.Printf("Possible prompt injection from user %d: %s\n", turn.thread.UserID, turn.question.InjectionFlags)
+	}
+
+	messages := append([]LLMMessage{{Role: "system", Content: system}}, history...)
+	turn.request = LLMRequest{Messages: append(messages, LLMMessage{Role: "user", Content: user})}
+
+	// Advice about lows and highs is only checked against a current reading
+	var latest []GlucoseReading
+	DB.Where("user_id = ? AND recorded_at >= ?", turn.thread.UserID, time.Now().Add(-chatReadingWindow)).
+		Order("recorded_at desc").Limit(1).Find(&latest)
+	turn.guard = newGuardrail(latest)
+	return turn, true
+}
+
+// complete fills in the reply
+func (t *chatTurn) complete(resp LLMResponse, content string, started time.Time) {
+	t.reply = ChatMessage{
+		ThreadID:         t.thread.ID,
+		Role:             "assistant",
+		Content:          strings.TrimSpace(content),
+		RawContent:       resp.Content,
+		PromptVersion:    chatPromptVersion,
+		Model:            resp.Model,
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		LatencyMS:        time.Since(started).Milliseconds(),
+	}
+}
+
+// saveChatTurn stores the question and the reply together, and the
+// guardrail violations of the reply
+func saveChatTurn(turn *chatTurn) error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&turn.question).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&turn.reply).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"updated_at": time.Now()}
+		if turn.thread.Title == "" {
+			turn.thread.Title = truncateRunes(normalizePromptText(turn.question.Content), maxPromptNameLength)
+			updates["title"] = turn.thread.Title
+		}
+		return tx.Model(&turn.thread).Updates(updates).Error
+	})
+	if err != nil {
+		fmt.Println("Error saving chat messages:", err)
+		return err
+	}
+
+	violations := turn.guard.violations
+	for i := range violations {
+		violations[i].ChatMessageID = turn.reply.ID
+		violations[i].UserID = turn.thread.UserID
+		fmt.Printf("Guardrail violation on chat message %d: %s %q\n", turn.reply.ID, violations[i].Rule, violations[i].Excerpt)
+	}
+	if len(violations) > 0 {
+		if err := DB.Create(&violations).Error; err != nil {
+			fmt.Println("Error saving guardrail violations:", err)
+		}
+	}
+	return nil
+}
+
+// chatHistory returns the newest messages of the thread that fit the history
+// budget. Older messages that aren't in the summary yet are added to it
+// first; if that fails they are left out.
+func chatHistory(ctx context.Context, thread *ChatThread) ([]LLMMessage, error) {
+	var messages []ChatMessage
+	if err := DB.Where("thread_id = ? AND id > ?", thread.ID, thread.SummarizedThroughID).Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	keep, used, budget := len(messages), 0, chatHistoryTokenBudget()
+	for keep > 0 && len(messages)-keep < chatRecentMessages {
+		tokens := estimateTokens(messages[keep-1].Content)
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		keep--
+	}
+
+	if older := messages[:keep]; len(older) > 0 {
+		summary, err := summarizeChat(ctx, thread.UserID, thread.Summary, older)
+		if err != nil {
+			fmt.Println("Error summarizing chat:", err)
+		} else {
+			thread.Summary, thread.SummarizedThroughID = summary, older[len(older)-1].ID
+			if err := DB.Model(thread).Updates(map[string]interface{}{
+				"summary":               thread.Summary,
+				"summarized_through_id": thread.SummarizedThroughID,
+			}).Error; err != nil {
+				fmt.Println("Error saving chat summary:", err)
+			}
+		}
+	}
+
+	history := make([]LLMMessage, 0, len(messages)-keep)
+	for _, message := range messages[keep:] {
+		content := message.Content
+		if message.Role == "user" {
+			content = normalizePromptText(content)
+		}
+		history = append(history, LLMMessage{Role: message.Role, Content: content})
+	}
+	return history, nil
+}
+
+// summarizeChat folds messages into the summary of the earlier conversation
+func summarizeChat(ctx context.Context, userID uint, summary string, messages []ChatMessage) (string, error) {
+	sanitizer := &promptSanitizer{}
+	var sb strings.Builder
+	sb.WriteString(userDataOpen + "\n")
+	if summary != "" {
+		sb.WriteString("Summary so far: " + sanitizer.inspect("chat_summary", summary, maxChatSummaryLength) + "\n")
+	}
+	for _, message := range messages {
+		speaker := "Person"
+		if message.Role == "assistant" {
+			speaker = "Assistant"
+		}
+		sb.WriteString(speaker + " said: " + sanitizer.inspect("chat_message", message.Content, maxChatMessageLength) + "\n")
+	}
+	sb.WriteString(userDataClose)
+
+	resp, err := llm.Complete(ctx, LLMRequest{Messages: []LLMMessage{
+		{
+			Role: "system",
+			Content: "You summarise a conversation between a person with diabetes and their diet assistant so it can be continued later. " +
+				"Keep the foods, readings, questions, advice and preferences that were discussed. Answer with the summary only, in at most 150 words. " +
+				userDataInstruction,
+		},
+		{Role: "user", Content: sb.String()},
+	}})
+	if err != nil {
+		return "", err
+	}
+	recordAIUsage(userID, resp.PromptTokens, resp.CompletionTokens)
+	return truncateRunes(strings.TrimSpace(resp.Content), maxChatSummaryLength), nil
+}
+
+// chatUserData is the data block sent with every question: the latest meals,
+// the patient context with the latest readings and the summary of earlier
+// turns, with times in loc
+func chatUserData(userID uint, summary string, loc *time.Location, sanitizer *promptSanitizer) string {
+	var sb strings.Builder
+	sb.WriteString(userDataOpen + "\n")
+
+	var meals []DietLog
+	DB.Where("user_id = ?", userID).Order("timestamp desc").Limit(chatLatestMeals).Find(&meals)
+	if len(meals) > 0 {
+		sb.WriteString("Latest meals:\n")
+		for _, meal := range meals {
+			sb.WriteString(fmt.Sprintf("- %s: %s (%d cal, %.0f g carbohydrates)\n", meal.Timestamp.In(loc).Format("Jan 2 15:04"),
+				sanitizer.clean("food_description", meal.FoodDescription, maxPromptFieldLength), meal.Calories, meal.Carbs))
+		}
+	}
+	sb.WriteString(assembleContext(userID, nil, contextTokenBudget(), loc, sanitizer))
+	if summary != "" {
+		sb.WriteString("Summary of the earlier conversation:\n" + sanitizer.clean("chat_summary", summary, maxChatSummaryLength) + "\n")
+	}
+
+	sb.WriteString(userDataClose)
+	return sb.String()
+}
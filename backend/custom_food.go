@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CustomFood is a private food created by a user when something is missing
+// from the database. Nutrient values are per 100 g, like the database foods.
+type CustomFood struct {
+	ID            uint                `gorm:"primaryKey" json:"id"`
+	UserID        uint                `gorm:"not null;uniqueIndex:idx_custom_food_user_key" json:"user_id"`
+	FoodKey       string              `gorm:"not null;uniqueIndex:idx_custom_food_user_key" json:"food_key"`
+	Name          string              `gorm:"not null" json:"name"`
+	Description   string              `json:"description"`
+	Calories      float64             `json:"calories"`
+	Carbs         float64             `json:"carbs"`
+	Fiber         float64             `json:"fiber"`
+	Sugar         float64             `json:"sugar"`
+	Protein       float64             `json:"protein"`
+	Fat           float64             `json:"fat"`
+	Sodium        float64             `json:"sodium"` // mg
+	GlycemicIndex int                 `json:"glycemic_index"`
+	Nutrients     string              `json:"nutrients"` // any further nutrients, JSON per 100 g
+	Portions      []CustomFoodPortion `gorm:"foreignKey:CustomFoodID;constraint:OnDelete:CASCADE" json:"portions"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+}
+
+// CustomFoodPortion is a named portion unit of a custom food, e.g. "slice" = 30 g
+type CustomFoodPortion struct {
+	ID           uint    `gorm:"primaryKey" json:"id"`
+	CustomFoodID uint    `gorm:"not null;index" json:"custom_food_id"`
+	Unit         string  `gorm:"not null" json:"unit" binding:"required"`
+	Grams        float64 `gorm:"not null" json:"grams" binding:"required,gt=0"`
+}
+
+type customFoodInput struct {
+	Name          string              `json:"name" binding:"required"`
+	Description   string              `json:"description"`
+	Calories      float64             `json:"calories" binding:"gte=0"`
+	Carbs         float64             `json:"carbs" binding:"gte=0"`
+	Fiber         float64             `json:"fiber" binding:"gte=0"`
+	Sugar         float64             `json:"sugar" binding:"gte=0"`
+	Protein       float64             `json:"protein" binding:"gte=0"`
+	Fat           float64             `json:"fat" binding:"gte=0"`
+	Sodium        float64             `json:"sodium" binding:"gte=0"`
+	GlycemicIndex int                 `json:"glycemic_index" binding:"gte=0,lte=110"`
+	Nutrients     string              `json:"nutrients"`
+	Portions      []CustomFoodPortion `json:"portions" binding:"dive"`
+}
+
+func (input customFoodInput) apply(food *CustomFood) {
+	food.FoodKey = foodKey(input.Name)
+	food.Name = strings.TrimSpace(input.Name)
+	food.Description = input.Description
+	food.Calories = input.Calories
+	food.Carbs = input.Carbs
+	food.Fiber = input.Fiber
+	food.Sugar = input.Sugar
+	food.Protein = input.Protein
+	food.Fat = input.Fat
+	food.Sodium = input.Sodium
+	food.GlycemicIndex = input.GlycemicIndex
+	food.Nutrients = input.Nutrients
+	food.Portions = nil
+	for _, portion := range input.Portions {
+		food.Portions = append(food.Portions, CustomFoodPortion{
+			CustomFoodID: food.ID,
+			Unit:         strings.ToLower(strings.TrimSpace(portion.Unit)),
+			Grams:        portion.Grams,
+		})
+	}
+}
+
+func (f CustomFood) resolved() ResolvedFood {
+	portions := make(map[string]float64, len(f.Portions))
+	for _, portion := range f.Portions {
+		portions[portion.Unit] = portion.Grams
+	}
+	return ResolvedFood{
+		Name:         f.Name,
+		Description:  f.Description,
+		Source:       "custom",
+		CustomFoodID: f.ID,
+		Per100g: FoodNutrition{
+			Calories:      f.Calories,
+			Carbs:         f.Carbs,
+			Fiber:         f.Fiber,
+			Sugar:         f.Sugar,
+			Protein:       f.Protein,
+			Fat:           f.Fat,
+			GlycemicIndex: f.GlycemicIndex,
+		},
+		Portions: portions,
+	}
+}
+
+// POST /foods/custom
+func CreateCustomFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input customFoodInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	food := CustomFood{UserID: userID.(uint)}
+	input.apply(&food)
+
+	var existing CustomFood
+	if err := DB.Where("user_id = ? AND food_key = ?", food.UserID, food.FoodKey).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have a custom food with this name"})
+		return
+	}
+
+	if err := DB.Create(&food).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save custom food"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom food saved", "food": food})
+}
+
+// GET /foods/custom
+func GetCustomFoods(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var foods []CustomFood
+	if err := DB.Preload("Portions").Where("user_id = ?", userID.(uint)).Order("name").Find(&foods).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve custom foods"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"foods": foods})
+}
+
+// PUT /foods/custom/:id
+// Already logged meals keep the nutrition they were logged with.
+func UpdateCustomFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var food CustomFood
+	if err := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&food).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom food not found"})
+		return
+	}
+
+	var input customFoodInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var clash CustomFood
+	if err := DB.Where("user_id = ? AND food_key = ? AND id <> ?", food.UserID, foodKey(input.Name), food.ID).First(&clash).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have a custom food with this name"})
+		return
+	}
+	input.apply(&food)
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("custom_food_id = ?", food.ID).Delete(&CustomFoodPortion{}).Error; err != nil {
+			return err
+		}
+		if len(food.Portions) > 0 {
+			if err := tx.Create(&food.Portions).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Omit("Portions").Save(&food).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update custom food"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom food updated", "food": food})
+}
+
+// DELETE /foods/custom/:id
+func DeleteCustomFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&CustomFood{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete custom food"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom food not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom food deleted"})
+}
+
+// POST /foods/log
+// Logs a quantity of a database or custom food as a diet entry, so nutrition
+// doesn't have to be typed by hand.
+func LogFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Food      string     `json:"food" binding:"required"`
+		Quantity  float64    `json:"quantity" binding:"required,gt=0"`
+		Unit      string     `json:"unit"`
+		MealType  string     `json:"meal_type"`
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	timestamp, err := mealTimestamp(input.Timestamp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mealType, err := normalizeMealType(input.MealType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	food, ok := resolveFood(userID.(uint), input.Food)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return
+	}
+	unit := input.Unit
+	if unit == "" {
+		unit = "g"
+	}
+	grams, err := food.grams(input.Quantity, unit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	nutrition := food.Per100g.scaled(grams / 100).rounded()
+	portion := fmt.Sprintf("%g %s", input.Quantity, unit)
+	dietLog := DietLog{
+		UserID:          userID.(uint),
+		Timestamp:       timestamp,
+		FoodDescription: fmt.Sprintf("%s (%s)", food.Name, portion),
+		Calories:        uint(math.Round(nutrition.Calories)),
+		Nutrients: nutrientsString(map[string]float64{
+			"carbohydrates": nutrition.Carbs,
+			"fiber":         nutrition.Fiber,
+			"sugar":         nutrition.Sugar,
+			"protein":       nutrition.Protein,
+			"fat":           nutrition.Fat,
+		}),
+		MealType: mealType,
+		Items: []DietLogItem{{
+			FoodName:      food.Name,
+			Portion:       portion,
+			Quantity:      1,
+			Calories:      uint(math.Round(nutrition.Calories)),
+			Carbs:         nutrition.Carbs,
+			Fiber:         nutrition.Fiber,
+			GlycemicIndex: nutrition.GlycemicIndex,
+		}},
+	}
+	applyGlycemicLoad(&dietLog)
+
+	if err := DB.Create(&dietLog).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Diet log saved",
+		"food":    food,
+		"data":    dietLog,
+	})
+}
@@ -35,6 +35,31 @@ func InitDB() {
 		&Medication{},
 		&Appointment{},
 		&DietLog{},
+		&DietLogItem{},
+		&DietLogRevision{},
 		&RefreshToken{},
+		&FoodProduct{},
+		&MealTemplate{},
+		&MealTemplateItem{},
+		&FavoriteFood{},
+		&Recipe{},
+		&RecipeIngredient{},
+		&CustomFood{},
+		&CustomFoodPortion{},
+		&FluidIntake{},
+		&MealPlan{},
+		&MealPlanDay{},
+		&PlannedMeal{},
+		&Note{},
+		&Tag{},
+		&EntryTag{},
+		&Recommendation{},
+		&GuardrailViolation{},
+		&ChatThread{},
+		&ChatMessage{},
+		&AIUsage{},
+		&RecommendationFeedback{},
 	)
+
+	createSearchIndexes()
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Consensus target range for time-in-range, in mg/dL
+const (
+	targetRangeLow  = 70
+	targetRangeHigh = 180
+)
+
+// DayAggregate is the per-day summary shown on the calendar screen
+type DayAggregate struct {
+	Date         string   `json:"date"`
+	ReadingCount int      `json:"reading_count"`
+	MinGlucose   *float64 `json:"min_glucose"`
+	MaxGlucose   *float64 `json:"max_glucose"`
+	MeanGlucose  *float64 `json:"mean_glucose"`
+	TimeInRange  *float64 `json:"time_in_range"` // percent of readings within the target range
+	Carbs        float64  `json:"carbs"`
+	Calories     float64  `json:"calories"`
+	Meals        int      `json:"meals"`
+	Color        string   `json:"color"` // heatmap bucket: none, green, yellow or red
+}
+
+// GET /days?from=YYYY-MM-DD&to=YYYY-MM-DD&tz=Area/City
+// Glucose statistics are computed by the database so only one row per day is
+// transferred.
+func GetDays(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := requestDateRange(c, loc, 30)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var glucoseRows []struct {
+		Day     string
+		Count   int
+		Min     float64
+		Max     float64
+		Mean    float64
+		InRange int
+	}
+	err = DB.Model(&GlucoseReading{}).
+		Select("to_char(recorded_at AT TIME ZONE ?, 'YYYY-MM-DD') AS day, COUNT(*) AS count, MIN(level) AS min, MAX(level) AS max, AVG(level) AS mean,"+
+			" COUNT(*) FILTER (WHERE level >= ? AND level <= ?) AS in_range", loc.String(), targetRangeLow, targetRangeHigh).
+		Where("user_id = ? AND recorded_at >= ? AND recorded_at < ?", userID.(uint), from, to).
+		Group("day").Scan(&glucoseRows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve glucose readings"})
+		return
+	}
+
+	// Carbs of older meals may only be in the nutrients JSON, so meals are
+	// summed here with only the columns that are needed
+	var meals []DietLog
+	if err := DB.Select("timestamp", "calories", "carbs", "nutrients").
+		Where("user_id = ? AND timestamp >= ? AND timestamp < ?", userID.(uint), from, to).
+		Find(&meals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve diet logs"})
+		return
+	}
+
+	var fluidRows []struct {
+		Day      string
+		Carbs    float64
+		Calories float64
+	}
+	err = DB.Model(&FluidIntake{}).
+		Select("to_char(recorded_at AT TIME ZONE ?, 'YYYY-MM-DD') AS day, SUM(carbs) AS carbs, SUM(calories) AS calories", loc.String()).
+		Where("user_id = ? AND recorded_at >= ? AND recorded_at < ?", userID.(uint), from, to).
+		Group("day").Scan(&fluidRows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve fluid intake"})
+		return
+	}
+
+	// Every day of the range is returned, also those without data
+	var days []*DayAggregate
+	byDate := map[string]*DayAggregate{}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		aggregate := &DayAggregate{Date: day.Format("2006-01-02"), Color: "none"}
+		days = append(days, aggregate)
+		byDate[aggregate.Date] = aggregate
+	}
+
+	for _, row := range glucoseRows {
+		day := byDate[row.Day]
+		if day == nil || row.Count == 0 {
+			continue
+		}
+		lowest, highest, mean := round1(row.Min), round1(row.Max), round1(row.Mean)
+		tir := round1(float64(row.InRange) / float64(row.Count) * 100)
+		day.ReadingCount = row.Count
+		day.MinGlucose, day.MaxGlucose, day.MeanGlucose, day.TimeInRange = &lowest, &highest, &mean, &tir
+		day.Color = heatmapColor(tir)
+	}
+	for _, meal := range meals {
+		day := byDate[meal.Timestamp.In(loc).Format("2006-01-02")]
+		if day == nil {
+			continue
+		}
+		day.Carbs += mealCarbs(meal)
+		day.Calories += float64(meal.Calories)
+		day.Meals++
+	}
+	for _, row := range fluidRows {
+		if day := byDate[row.Day]; day != nil {
+			day.Carbs += row.Carbs
+			day.Calories += row.Calories
+		}
+	}
+	for _, day := range days {
+		day.Carbs = round1(day.Carbs)
+		day.Calories = round1(day.Calories)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"days":         days,
+		"target_range": gin.H{"low": targetRangeLow, "high": targetRangeHigh},
+	})
+}
+
+// heatmapColor buckets a day by its time-in-range. 70% is the usual
+// recommended minimum.
+func heatmapColor(timeInRange float64) string {
+	switch {
+	case timeInRange >= 70:
+		return "green"
+	case timeInRange >= 50:
+		return "yellow"
+	default:
+		return "red"
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+    "encoding/json"
+    "errors"
+    "math"
     "time"
     "gorm.io/gorm"
     "github.com/gin-gonic/gin"
     "net/http"
 )
 
+// maxClockSkew tolerates phones whose clock runs slightly ahead of the server
+const maxClockSkew = 5 * time.Minute
+
 type DietLog struct {
     gorm.Model
     UserID          uint      `json:"user_id"`
@@ -14,8 +20,165 @@ type DietLog struct {
     FoodDescription string    `json:"food_description" binding:"required"`
     Calories        uint      `json:"calories"`
     Nutrients       string    `json:"nutrients"`
+    MealType        string    `json:"meal_type"` // breakfast, lunch, dinner or snack, inferred from the time when empty
+    Carbs           float64   `json:"carbs"`         // total carbohydrate of the meal, g
+    GlycemicLoad    float64   `json:"glycemic_load"` // sum of the items' glycemic load
+    Items           []DietLogItem `gorm:"foreignKey:DietLogID" json:"items"`
+}
+
+// DietLogItem is a single food within a meal. Carbs and Fiber are per portion,
+// Quantity is the number of portions eaten.
+type DietLogItem struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    DietLogID      uint    `gorm:"not null;index" json:"diet_log_id"`
+    FoodName       string  `json:"food_name"`
+    Portion        string  `json:"portion"`
+    Quantity       float64 `gorm:"default:1" json:"quantity"`
+    Calories       uint    `json:"calories"`
+    Carbs          float64 `json:"carbs"`
+    Fiber          float64 `json:"fiber"`
+    GlycemicIndex  int     `json:"glycemic_index"`
+    AvailableCarbs float64 `json:"available_carbs"` // (carbs - fiber) x quantity
+    GlycemicLoad   float64 `json:"glycemic_load"`
+}
+
+// DietLogRevision keeps a snapshot of a diet log before it was edited or
+// deleted, so corrections stay auditable
+type DietLogRevision struct {
+    ID        uint      `gorm:"primaryKey" json:"id"`
+    DietLogID uint      `gorm:"not null;index" json:"diet_log_id"`
+    UserID    uint      `gorm:"not null;index" json:"user_id"`
+    Action    string    `gorm:"not null" json:"action"` // "update" or "delete"
+    Snapshot  string    `gorm:"type:text" json:"snapshot"` // JSON of the entry before the change
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// DailyGlycemicLoad totals the meals of one calendar day. Meals whose
+// glycemic load is unknown are counted in UnknownMeals but not in the load,
+// Partial marks a day that has some of them.
+type DailyGlycemicLoad struct {
+    Date         string  `json:"date"`
+    Meals        int     `json:"meals"`
+    UnknownMeals int     `json:"unknown_meals"`
+    Carbs        float64 `json:"carbs"`
+    GlycemicLoad float64 `json:"glycemic_load"`
+    Category     string  `json:"category"` // low, medium or high, unknown when no meal's load is known
+    Partial      bool    `json:"partial"`
+}
+
+// applyGlycemicLoad fills in the computed per-item and per-meal values.
+// Meals without items fall back to the carbohydrates in Nutrients, their
+// glycemic load stays unknown (zero).
+func applyGlycemicLoad(meal *DietLog) {
+    if len(meal.Items) == 0 {
+        nutrients := parseNutrients(meal.Nutrients)
+        meal.Carbs = round1(nutrientValue(nutrients, carbohydrateKeys...))
+        meal.GlycemicLoad = 0
+        return
+    }
+
+    var carbs, load float64
+    for i := range meal.Items {
+        item := &meal.Items[i]
+        if item.Quantity <= 0 {
+            item.Quantity = 1
+        }
+        item.AvailableCarbs = round1(availableCarbs(item.Carbs, item.Fiber) * item.Quantity)
+        item.GlycemicLoad = glycemicLoad(item.GlycemicIndex, item.Carbs*item.Quantity, item.Fiber*item.Quantity)
+        carbs += item.Carbs * item.Quantity
+        load += item.GlycemicLoad
+    }
+    meal.Carbs = round1(carbs)
+    meal.GlycemicLoad = round1(load)
+}
+
+// glycemicLoadKnown reports whether every item of the meal has a glycemic
+// index; meals without items have no glycemic load
+func glycemicLoadKnown(meal DietLog) bool {
+    if len(meal.Items) == 0 {
+        return false
+    }
+    for _, item := range meal.Items {
+        if item.GlycemicIndex <= 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// replaceDietLogItems gives a stored meal new items. Its calories and the
+// carbohydrate and fiber in its nutrients are recomputed from them; a meal
+// left without items keeps the totals it had.
+func replaceDietLogItems(meal *DietLog, items []DietLogItem) {
+    meal.Items = items
+    if len(items) == 0 {
+        return
+    }
+    var calories, carbs, fiber float64
+    for i := range meal.Items {
+        item := &meal.Items[i]
+        item.ID = 0
+        item.DietLogID = meal.ID
+        quantity := item.Quantity
+        if quantity <= 0 {
+            quantity = 1
+        }
+        calories += float64(item.Calories) * quantity
+        carbs += item.Carbs * quantity
+        fiber += item.Fiber * quantity
+    }
+    meal.Calories = uint(math.Round(calories))
+    meal.Nutrients = nutrientsString(map[string]float64{"carbohydrates": round1(carbs), "fiber": round1(fiber)})
+}
+
+// resetDietLogIDs clears the IDs a client may send with a new meal, so its
+// items can't be attached to or overwrite the items of another meal
+func resetDietLogIDs(meal *DietLog) {
+    meal.Model = gorm.Model{}
+    for i := range meal.Items {
+        meal.Items[i].ID = 0
+        meal.Items[i].DietLogID = 0
+    }
 }
 
+// dailyGlycemicLoads groups meals by calendar day in loc, most recent first
+func dailyGlycemicLoads(logs []DietLog, loc *time.Location) []DailyGlycemicLoad {
+    days := []DailyGlycemicLoad{}
+    index := map[string]int{}
+    for _, meal := range logs {
+        date := meal.Timestamp.In(loc).Format("2006-01-02")
+        i, ok := index[date]
+        if !ok {
+            i = len(days)
+            index[date] = i
+            days = append(days, DailyGlycemicLoad{Date: date})
+        }
+        days[i].Meals++
+        days[i].Carbs += meal.Carbs
+        if !glycemicLoadKnown(meal) {
+            days[i].UnknownMeals++
+            continue
+        }
+        days[i].GlycemicLoad += meal.GlycemicLoad
+    }
+    for i := range days {
+        days[i].Carbs = round1(days[i].Carbs)
+        days[i].GlycemicLoad = round1(days[i].GlycemicLoad)
+        days[i].Partial = days[i].UnknownMeals > 0 && days[i].UnknownMeals < days[i].Meals
+        // A day is the sum of several meals, the conventional daily thresholds are 80/120
+        switch {
+        case days[i].UnknownMeals == days[i].Meals:
+            days[i].Category = "unknown"
+        case days[i].GlycemicLoad > 120:
+            days[i].Category = "high"
+        case days[i].GlycemicLoad >= 80:
+            days[i].Category = "medium"
+        default:
+            days[i].Category = "low"
+        }
+    }
+    return days
+}
 
 func AddDietLog(c *gin.Context) {
     var input DietLog
@@ -31,8 +194,22 @@ func AddDietLog(c *gin.Context) {
         return
     }
 
+    timestamp, err := mealTimestamp(&input.Timestamp)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    mealType, err := normalizeMealType(input.MealType)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    resetDietLogIDs(&input)
     input.UserID = userID.(uint)
-    input.Timestamp = time.Now()
+    input.Timestamp = timestamp
+    input.MealType = mealType
+    applyGlycemicLoad(&input)
 
     if err := DB.Create(&input).Error; err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
@@ -52,14 +229,213 @@ func GetDietLogs(c *gin.Context) {
         return
     }
 
+    loc, err := requestLocation(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
     var logs []DietLog
-    if err := DB.Where("user_id = ?", userID.(uint)).Order("timestamp desc").Find(&logs).Error; err != nil {
+    if err := DB.Preload("Items").Where("user_id = ?", userID.(uint)).Order("timestamp desc").Find(&logs).Error; err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve diet logs"})
         return
     }
 
     c.JSON(http.StatusOK, gin.H{
-        "user_id":  userID,
-        "readings": logs,
+        "user_id":             userID,
+        "readings":            logs,
+        "daily_glycemic_load": dailyGlycemicLoads(logs, loc),
+    })
+}
+
+// PATCH /diet/:id
+// Only the fields present in the body are changed. Sending items replaces all
+// items of the meal.
+func UpdateDietLog(c *gin.Context) {
+    userID, exists := c.Get("user_id")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var input struct {
+        FoodDescription *string        `json:"food_description"`
+        Calories        *uint          `json:"calories"`
+        Nutrients       *string        `json:"nutrients"`
+        MealType        *string        `json:"meal_type"`
+        Timestamp       *time.Time     `json:"timestamp"`
+        Items           *[]DietLogItem `json:"items"`
+    }
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    var dietLog DietLog
+    if err := DB.Preload("Items").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&dietLog).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Diet log not found"})
+        return
+    }
+    before := dietLog
+
+    if input.FoodDescription != nil {
+        if *input.FoodDescription == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "food_description cannot be empty"})
+            return
+        }
+        dietLog.FoodDescription = *input.FoodDescription
+    }
+    // New items replace the meal's totals unless the request sets them too
+    if input.Items != nil {
+        replaceDietLogItems(&dietLog, *input.Items)
+    }
+    if input.Calories != nil {
+        dietLog.Calories = *input.Calories
+    }
+    if input.Nutrients != nil {
+        dietLog.Nutrients = *input.Nutrients
+    }
+    if input.MealType != nil {
+        mealType, err := normalizeMealType(*input.MealType)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        dietLog.MealType = mealType
+    }
+    if input.Timestamp != nil {
+        timestamp, err := mealTimestamp(input.Timestamp)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        dietLog.Timestamp = timestamp
+    }
+    applyGlycemicLoad(&dietLog)
+
+    err := DB.Transaction(func(tx *gorm.DB) error {
+        if err := recordDietLogRevision(tx, before, "update"); err != nil {
+            return err
+        }
+        if input.Items != nil {
+            if err := tx.Where("diet_log_id = ?", dietLog.ID).Delete(&DietLogItem{}).Error; err != nil {
+                return err
+            }
+            if len(dietLog.Items) > 0 {
+                if err := tx.Create(&dietLog.Items).Error; err != nil {
+                    return err
+                }
+            }
+        }
+        return tx.Omit("Items").Save(&dietLog).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update diet log"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "message": "Diet log updated",
+        "data":    dietLog,
+    })
+}
+
+// DELETE /diet/:id
+// The entry is soft-deleted: it disappears from every listing but the row and
+// a revision snapshot are kept for auditing.
+func DeleteDietLog(c *gin.Context) {
+    userID, exists := c.Get("user_id")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var dietLog DietLog
+    if err := DB.Preload("Items").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&dietLog).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Diet log not found"})
+        return
+    }
+
+    err := DB.Transaction(func(tx *gorm.DB) error {
+        if err := recordDietLogRevision(tx, dietLog, "delete"); err != nil {
+            return err
+        }
+        return tx.Delete(&dietLog).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete diet log"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Diet log deleted"})
+}
+
+// GET /diet/:id/revisions
+// Works for deleted entries too, so a removed meal can still be traced.
+func GetDietLogRevisions(c *gin.Context) {
+    userID, exists := c.Get("user_id")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var dietLog DietLog
+    if err := DB.Unscoped().Preload("Items").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&dietLog).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Diet log not found"})
+        return
+    }
+
+    var revisions []DietLogRevision
+    if err := DB.Where("diet_log_id = ?", dietLog.ID).Order("created_at desc").Find(&revisions).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve revisions"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "current":   dietLog,
+        "deleted":   dietLog.DeletedAt.Valid,
+        "revisions": revisions,
     })
 }
+
+func recordDietLogRevision(tx *gorm.DB, dietLog DietLog, action string) error {
+    snapshot, err := json.Marshal(dietLog)
+    if err != nil {
+        return err
+    }
+    return tx.Create(&DietLogRevision{
+        DietLogID: dietLog.ID,
+        UserID:    dietLog.UserID,
+        Action:    action,
+        Snapshot:  string(snapshot),
+    }).Error
+}
+
+// mealTimestamp validates a client supplied meal time, defaulting to now.
+// Meals can be backdated but not logged in the future.
+func mealTimestamp(requested *time.Time) (time.Time, error) {
+    now := time.Now()
+    if requested == nil || requested.IsZero() {
+        return now, nil
+    }
+    if requested.After(now.Add(maxClockSkew)) {
+        return time.Time{}, errors.New("timestamp cannot be in the future")
+    }
+    return *requested, nil
+}
+
+// todaysMeals returns the user's meals since local midnight, most recent
+// first. The meal that was just logged is always included.
+func todaysMeals(latest DietLog) []DietLog {
+    now := time.Now()
+    midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+    var logs []DietLog
+    err := DB.Preload("Items").
+        Where("user_id = ? AND timestamp >= ? AND id <> ?", latest.UserID, midnight, latest.ID).
+        Order("timestamp desc").Find(&logs).Error
+    if err != nil {
+        return []DietLog{latest}
+    }
+    return append([]DietLog{latest}, logs...)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestReplaceDietLogItemsRecomputesTotals(t *testing.T) {
+	meal := DietLog{Calories: 900, Nutrients: `{"carbohydrates": 120, "protein": 30}`}
+	meal.ID = 7
+	replaceDietLogItems(&meal, []DietLogItem{
+		{ID: 3, FoodName: "rice", Quantity: 2, Calories: 200, Carbs: 45, Fiber: 1, GlycemicIndex: 70},
+		{ID: 4, FoodName: "lentils", Calories: 230, Carbs: 40, Fiber: 15.6, GlycemicIndex: 30},
+	})
+	applyGlycemicLoad(&meal)
+
+	if meal.Calories != 630 {
+		t.Errorf("Calories = %d, want 630", meal.Calories)
+	}
+	nutrients := parseNutrients(meal.Nutrients)
+	if carbs := nutrientValue(nutrients, carbohydrateKeys...); carbs != 130 {
+		t.Errorf("carbohydrates in Nutrients = %v, want 130", carbs)
+	}
+	if fiber := nutrientValue(nutrients, fiberKeys...); fiber != 17.6 {
+		t.Errorf("fiber in Nutrients = %v, want 17.6", fiber)
+	}
+	if _, ok := nutrients["protein"]; ok {
+		t.Errorf("Nutrients = %s, still has the protein of the old items", meal.Nutrients)
+	}
+	if meal.Carbs != 130 {
+		t.Errorf("Carbs = %v, want 130", meal.Carbs)
+	}
+	for _, item := range meal.Items {
+		if item.ID != 0 || item.DietLogID != 7 {
+			t.Errorf("item %s has ID %d and DietLogID %d, want 0 and 7", item.FoodName, item.ID, item.DietLogID)
+		}
+	}
+}
+
+func TestReplaceDietLogItemsWithoutItemsKeepsTotals(t *testing.T) {
+	meal := DietLog{Calories: 450, Nutrients: `{"carbohydrates": 60}`}
+	replaceDietLogItems(&meal, []DietLogItem{})
+	if meal.Calories != 450 || meal.Nutrients != `{"carbohydrates": 60}` {
+		t.Errorf("Calories = %d, Nutrients = %s, want the old totals", meal.Calories, meal.Nutrients)
+	}
+}
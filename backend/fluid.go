@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alcohol keeps lowering glucose for many hours, so drinks in this window are
+// reported to the recommendation logic
+const alcoholLookback = 24 * time.Hour
+
+var beverageTypes = []string{"water", "coffee", "tea", "juice", "soda", "diet_soda", "milk", "sports_drink", "beer", "wine", "spirits", "other"}
+
+// FluidIntake is a drink: water, sugary drinks and alcohol alike
+type FluidIntake struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       uint      `gorm:"not null;index" json:"user_id"`
+	RecordedAt   time.Time `gorm:"not null;index" json:"recorded_at"`
+	BeverageType string    `gorm:"not null" json:"beverage_type"`
+	Name         string    `json:"name"`
+	VolumeML     float64   `gorm:"column:volume_ml" json:"volume_ml"`
+	Calories     float64   `json:"calories"`
+	Carbs        float64   `json:"carbs"`
+	AlcoholUnits float64   `json:"alcohol_units"` // 1 unit = 10 ml of pure alcohol
+	Notes        string    `json:"notes"`
+}
+
+// FluidTotals are the per-day drink figures added to intake summaries
+type FluidTotals struct {
+	VolumeML     float64 `json:"volume_ml"`
+	WaterML      float64 `json:"water_ml"`
+	Carbs        float64 `json:"carbs"`
+	Calories     float64 `json:"calories"`
+	AlcoholUnits float64 `json:"alcohol_units"`
+	Drinks       int     `json:"drinks"`
+}
+
+func (t *FluidTotals) add(f FluidIntake) {
+	t.VolumeML += f.VolumeML
+	if f.BeverageType == "water" {
+		t.WaterML += f.VolumeML
+	}
+	t.Carbs += f.Carbs
+	t.Calories += f.Calories
+	t.AlcoholUnits += f.AlcoholUnits
+	t.Drinks++
+}
+
+func (t FluidTotals) rounded() FluidTotals {
+	return FluidTotals{
+		VolumeML:     round1(t.VolumeML),
+		WaterML:      round1(t.WaterML),
+		Carbs:        round1(t.Carbs),
+		Calories:     round1(t.Calories),
+		AlcoholUnits: round1(t.AlcoholUnits),
+		Drinks:       t.Drinks,
+	}
+}
+
+// POST /fluids
+func AddFluidIntake(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		FluidIntake
+		ABV        float64    `json:"abv"` // alcohol by volume in percent, used when alcohol_units is not given
+		RecordedAt *time.Time `json:"recorded_at"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	intake := input.FluidIntake
+	intake.ID = 0
+	intake.UserID = userID.(uint)
+	intake.BeverageType = strings.ToLower(strings.TrimSpace(intake.BeverageType))
+	if !isBeverageType(intake.BeverageType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "beverage_type must be one of " + strings.Join(beverageTypes, ", ")})
+		return
+	}
+	if intake.VolumeML <= 0 || intake.Carbs < 0 || intake.Calories < 0 || intake.AlcoholUnits < 0 || input.ABV < 0 || input.ABV > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "volume_ml must be positive and nutrition values cannot be negative"})
+		return
+	}
+	if intake.AlcoholUnits == 0 && input.ABV > 0 {
+		intake.AlcoholUnits = round1(intake.VolumeML * input.ABV / 1000)
+	}
+
+	recordedAt, err := mealTimestamp(input.RecordedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	intake.RecordedAt = recordedAt
+
+	if err := DB.Create(&intake).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save fluid intake"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Fluid intake saved",
+		"data":    intake,
+	})
+}
+
+// GET /fluids?from=YYYY-MM-DD&to=YYYY-MM-DD&tz=Area/City
+func GetFluidIntakes(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := requestDateRange(c, loc, 7)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var intakes []FluidIntake
+	if err := DB.Where("user_id = ? AND recorded_at >= ? AND recorded_at < ?", userID.(uint), from, to).
+		Order("recorded_at desc").Find(&intakes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve fluid intake"})
+		return
+	}
+
+	daily := map[string]*FluidTotals{}
+	for _, intake := range intakes {
+		date := intake.RecordedAt.In(loc).Format("2006-01-02")
+		if daily[date] == nil {
+			daily[date] = &FluidTotals{}
+		}
+		daily[date].add(intake)
+	}
+	totals := make(map[string]FluidTotals, len(daily))
+	for date, t := range daily {
+		totals[date] = t.rounded()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":      userID,
+		"fluids":       intakes,
+		"daily_totals": totals,
+	})
+}
+
+// DELETE /fluids/:id
+func DeleteFluidIntake(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&FluidIntake{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete fluid intake"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fluid intake not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Fluid intake deleted"})
+}
+
+func isBeverageType(beverageType string) bool {
+	for _, known := range beverageTypes {
+		if beverageType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// recentAlcoholWarning describes the alcohol drunk in the last 24 hours, or
+// returns "" when there was none. It is added to the recommendation so both
+// the user and the AI are aware of the risk of delayed (overnight) lows. The
+// time of the last drink is given in loc.
+func recentAlcoholWarning(userID uint, loc *time.Location) string {
+	var intakes []FluidIntake
+	if err := DB.Where("user_id = ? AND recorded_at >= ? AND alcohol_units > 0", userID, time.Now().Add(-alcoholLookback)).
+		Order("recorded_at desc").Find(&intakes).Error; err != nil {
+		fmt.Println("Error loading recent alcohol intake:", err)
+		return ""
+	}
+	if len(intakes) == 0 {
+		return ""
+	}
+
+	var units float64
+	for _, intake := range intakes {
+		units += intake.AlcoholUnits
+	}
+	return fmt.Sprintf(" You have had %.1f units of alcohol in the last 24 hours (last drink at %s)."+
+		" Alcohol can cause delayed hypoglycemia for up to 24 hours, so check your glucose before bed and consider a snack with carbohydrates to prevent an overnight low.",
+		units, intakes[0].RecordedAt.In(loc).Format("Jan 2 15:04"))
+}
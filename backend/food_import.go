@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// importBatchSize is the number of products written per database round trip
+const importBatchSize = 500
+
+// FoodImportStats summarizes a run of ImportFoodProducts
+type FoodImportStats struct {
+	Read      int `json:"read"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Invalid   int `json:"invalid"`
+	Duplicate int `json:"duplicate"` // records replaced by a later one with the same barcode in the same batch
+}
+
+// offRecord is the subset of an Open Food Facts product that we import
+type offRecord struct {
+	Code            string
+	ProductName     string
+	Brands          string
+	ServingSize     string
+	ServingQuantity float64
+	LastModified    int64
+	Nutriments      map[string]float64
+}
+
+// ImportFoodProducts loads an Open Food Facts style dump into the food_products
+// table. JSONL (one product per line) and CSV/TSV exports are supported, either
+// of them optionally gzip-compressed.
+//
+// Imports are incremental: products are upserted by barcode, and a product
+// whose last_modified_t is not newer than the stored copy is left untouched, so
+// re-running the importer on a fresh dump only writes what changed.
+func ImportFoodProducts(path string) (FoodImportStats, error) {
+	var stats FoodImportStats
+
+	file, err := os.Open(path)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open dump: %w", err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	name := strings.ToLower(path)
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return stats, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	batch := make([]offRecord, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := saveProductBatch(batch, &stats)
+		batch = batch[:0]
+		return err
+	}
+	emit := func(rec offRecord) error {
+		stats.Read++
+		if normalizeBarcode(rec.Code) == "" {
+			stats.Invalid++
+			return nil
+		}
+		batch = append(batch, rec)
+		if len(batch) >= importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".jsonl"), strings.HasSuffix(name, ".json"), strings.HasSuffix(name, ".ndjson"):
+		err = readProductsJSONL(reader, emit, &stats)
+	case strings.HasSuffix(name, ".csv"), strings.HasSuffix(name, ".tsv"):
+		err = readProductsCSV(reader, emit)
+	default:
+		return stats, fmt.Errorf("unsupported dump format: %s", path)
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, flush()
+}
+
+// saveProductBatch upserts a batch, skipping products that have not changed
+// since the last import
+func saveProductBatch(records []offRecord, stats *FoodImportStats) error {
+	// Dumps occasionally contain the same barcode twice, keep the last one
+	latest := make(map[string]FoodProduct, len(records))
+	order := make([]string, 0, len(records))
+	for _, rec := range records {
+		product := rec.toProduct()
+		if _, seen := latest[product.Barcode]; seen {
+			stats.Duplicate++
+		} else {
+			order = append(order, product.Barcode)
+		}
+		latest[product.Barcode] = product
+	}
+
+	var existing []FoodProduct
+	if err := DB.Select("barcode", "source_modified_at").Where("barcode IN ?", order).Find(&existing).Error; err != nil {
+		return fmt.Errorf("failed to look up existing products: %w", err)
+	}
+	known := make(map[string]time.Time, len(existing))
+	for _, p := range existing {
+		known[p.Barcode] = p.SourceModifiedAt
+	}
+
+	pending := make(map[string]FoodProduct, len(latest))
+	for _, code := range order {
+		product := latest[code]
+		if modified, ok := known[code]; ok {
+			if !product.SourceModifiedAt.IsZero() && !product.SourceModifiedAt.After(modified) {
+				stats.Unchanged++
+				continue
+			}
+			stats.Updated++
+		} else {
+			stats.Inserted++
+		}
+		pending[code] = product
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	products := make([]FoodProduct, 0, len(pending))
+	for _, code := range order {
+		products = append(products, pending[code])
+	}
+
+	err := DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "barcode"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"product_name", "brands", "serving_size", "serving_quantity",
+			"energy_kcal_100g", "carbohydrates_100g", "sugars_100g", "fiber_100g",
+			"proteins_100g", "fat_100g", "saturated_fat_100g", "sodium_100g",
+			"source_modified_at", "updated_at",
+		}),
+	}).Create(&products).Error
+	if err != nil {
+		return fmt.Errorf("failed to save products: %w", err)
+	}
+	return nil
+}
+
+func (r offRecord) toProduct() FoodProduct {
+	n := r.Nutriments
+	kcal := n["energy-kcal_100g"]
+	if kcal == 0 && n["energy_100g"] > 0 {
+		// energy_100g is in kJ
+		kcal = n["energy_100g"] / 4.184
+	}
+	sodium := n["sodium_100g"]
+	if sodium == 0 && n["salt_100g"] > 0 {
+		sodium = n["salt_100g"] / 2.5
+	}
+
+	product := FoodProduct{
+		Barcode:           normalizeBarcode(r.Code),
+		ProductName:       strings.TrimSpace(r.ProductName),
+		Brands:            strings.TrimSpace(r.Brands),
+		ServingSize:       strings.TrimSpace(r.ServingSize),
+		ServingQuantity:   r.ServingQuantity,
+		EnergyKcal100g:    kcal,
+		Carbohydrates100g: n["carbohydrates_100g"],
+		Sugars100g:        n["sugars_100g"],
+		Fiber100g:         n["fiber_100g"],
+		Proteins100g:      n["proteins_100g"],
+		Fat100g:           n["fat_100g"],
+		SaturatedFat100g:  n["saturated-fat_100g"],
+		Sodium100g:        sodium,
+	}
+	if r.LastModified > 0 {
+		product.SourceModifiedAt = time.Unix(r.LastModified, 0).UTC()
+	}
+	return product
+}
+
+func readProductsJSONL(r io.Reader, emit func(offRecord) error, stats *FoodImportStats) error {
+	scanner := bufio.NewScanner(r)
+	// Full product documents can be very large
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		var doc struct {
+			Code            flexString             `json:"code"`
+			ProductName     string                 `json:"product_name"`
+			Brands          string                 `json:"brands"`
+			ServingSize     string                 `json:"serving_size"`
+			ServingQuantity flexFloat              `json:"serving_quantity"`
+			LastModified    flexFloat              `json:"last_modified_t"`
+			Nutriments      map[string]interface{} `json:"nutriments"`
+		}
+		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+			log.Printf("Skipping invalid product on line %d: %v", line, err)
+			stats.Read++
+			stats.Invalid++
+			continue
+		}
+
+		nutriments := make(map[string]float64, len(doc.Nutriments))
+		for key, value := range doc.Nutriments {
+			if f, ok := toFloat(value); ok {
+				nutriments[key] = f
+			}
+		}
+
+		err := emit(offRecord{
+			Code:            string(doc.Code),
+			ProductName:     doc.ProductName,
+			Brands:          doc.Brands,
+			ServingSize:     doc.ServingSize,
+			ServingQuantity: float64(doc.ServingQuantity),
+			LastModified:    int64(doc.LastModified),
+			Nutriments:      nutriments,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	return nil
+}
+
+func readProductsCSV(r io.Reader, emit func(offRecord) error) error {
+	buffered := bufio.NewReader(r)
+
+	// The official export is tab separated despite the .csv extension
+	header, err := buffered.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	firstLine := string(header)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	if strings.Count(firstLine, "\t") > strings.Count(firstLine, ",") {
+		reader.Comma = '\t'
+	}
+
+	columns, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	index := make(map[string]int, len(columns))
+	for i, name := range columns {
+		index[strings.TrimSpace(name)] = i
+	}
+	if _, ok := index["code"]; !ok {
+		return fmt.Errorf("dump has no code column")
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dump: %w", err)
+		}
+
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		number := func(name string) float64 {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(field(name)), 64)
+			return f
+		}
+
+		nutriments := make(map[string]float64)
+		for name := range index {
+			if strings.HasSuffix(name, "_100g") {
+				if f := number(name); f != 0 {
+					nutriments[name] = f
+				}
+			}
+		}
+
+		err = emit(offRecord{
+			Code:            field("code"),
+			ProductName:     field("product_name"),
+			Brands:          field("brands"),
+			ServingSize:     field("serving_size"),
+			ServingQuantity: number("serving_quantity"),
+			LastModified:    int64(number("last_modified_t")),
+			Nutriments:      nutriments,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flexFloat accepts both JSON numbers and numeric strings, dumps use either
+type flexFloat float64
+
+func (f *flexFloat) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	parsed, _ := toFloat(v)
+	*f = flexFloat(parsed)
+	return nil
+}
+
+// flexString accepts both JSON strings and numbers (some dumps store codes as numbers)
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case string:
+		*s = flexString(value)
+	case json.Number:
+		*s = flexString(value.String())
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
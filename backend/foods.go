@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FoodProfile is a per-food entry of ai_services/food_nutrients_db.json.
+// Values come from USDA data and are per 100 g.
+type FoodProfile struct {
+	Calories       float64            `json:"calories"`
+	Nutrients      map[string]float64 `json:"nutrients"`
+	GlycemicIndex  int                `json:"glycemic_index"`
+	PortionSize    string             `json:"portion_size"`
+	Description    string             `json:"description"`
+	DiabetesImpact string             `json:"diabetes_impact"`
+}
+
+// FoodNutrition is the nutrition of a given amount of a food
+type FoodNutrition struct {
+	Calories      float64 `json:"calories"`
+	Carbs         float64 `json:"carbs"`
+	Fiber         float64 `json:"fiber"`
+	Sugar         float64 `json:"sugar"`
+	Protein       float64 `json:"protein"`
+	Fat           float64 `json:"fat"`
+	GlycemicIndex int     `json:"glycemic_index"`
+}
+
+var (
+	foodDB     map[string]FoodProfile
+	foodDBOnce sync.Once
+)
+
+// foodNutrientsDB loads the shared nutrient database once. The path can be
+// overridden with FOOD_NUTRIENTS_DB, the default assumes the server runs from
+// the backend directory.
+func foodNutrientsDB() map[string]FoodProfile {
+	foodDBOnce.Do(func() {
+		path := os.Getenv("FOOD_NUTRIENTS_DB")
+		if path == "" {
+			path = "../ai_services/food_nutrients_db.json"
+		}
+
+		foodDB = map[string]FoodProfile{}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Warning: could not read food nutrients database %s: %v", path, err)
+			return
+		}
+		if err := json.Unmarshal(data, &foodDB); err != nil {
+			log.Printf("Warning: could not parse food nutrients database %s: %v", path, err)
+			foodDB = map[string]FoodProfile{}
+		}
+	})
+	return foodDB
+}
+
+// foodKey turns "Apple Pie" into the database key "apple_pie"
+func foodKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+}
+
+// likeEscaper escapes the LIKE wildcards, including the underscores keys use
+// for spaces, so a search only matches the text typed
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(text string) string {
+	return likeEscaper.Replace(text)
+}
+
+// lookupFood finds a food in the nutrient database
+func lookupFood(name string) (FoodProfile, bool) {
+	profile, ok := foodNutrientsDB()[foodKey(name)]
+	return profile, ok
+}
+
+// NutritionPer100g extracts the main figures of the profile
+func (p FoodProfile) NutritionPer100g() FoodNutrition {
+	values := make(map[string]float64, len(p.Nutrients))
+	for key, value := range p.Nutrients {
+		values[strings.ToLower(key)] = value
+	}
+	calories := p.Calories
+	if calories == 0 && values["energy"] > 0 {
+		// energy is in kJ in the USDA export
+		calories = values["energy"] / 4.184
+	}
+	return FoodNutrition{
+		Calories:      calories,
+		Carbs:         nutrientValue(values, carbohydrateKeys...),
+		Fiber:         nutrientValue(values, fiberKeys...),
+		Sugar:         nutrientValue(values, sugarKeys...),
+		Protein:       nutrientValue(values, proteinKeys...),
+		Fat:           nutrientValue(values, fatKeys...),
+		GlycemicIndex: p.GlycemicIndex,
+	}
+}
+
+// scaled returns the nutrition multiplied by factor, the GI is unchanged
+func (n FoodNutrition) scaled(factor float64) FoodNutrition {
+	return FoodNutrition{
+		Calories:      n.Calories * factor,
+		Carbs:         n.Carbs * factor,
+		Fiber:         n.Fiber * factor,
+		Sugar:         n.Sugar * factor,
+		Protein:       n.Protein * factor,
+		Fat:           n.Fat * factor,
+		GlycemicIndex: n.GlycemicIndex,
+	}
+}
+
+// rounded rounds every figure to one decimal for responses
+func (n FoodNutrition) rounded() FoodNutrition {
+	return FoodNutrition{
+		Calories:      round1(n.Calories),
+		Carbs:         round1(n.Carbs),
+		Fiber:         round1(n.Fiber),
+		Sugar:         round1(n.Sugar),
+		Protein:       round1(n.Protein),
+		Fat:           round1(n.Fat),
+		GlycemicIndex: n.GlycemicIndex,
+	}
+}
+
+// gramsFor converts a quantity to grams. Database profiles are per 100 g and
+// one "serving" of a database food is that 100 g reference amount.
+func gramsFor(quantity float64, unit string) (float64, error) {
+	switch strings.ToLower(strings.TrimSpace(unit)) {
+	case "", "g", "gram", "grams":
+		return quantity, nil
+	case "kg":
+		return quantity * 1000, nil
+	case "oz":
+		return quantity * 28.35, nil
+	case "serving", "servings":
+		return quantity * 100, nil
+	}
+	return 0, fmt.Errorf("unsupported unit %q", unit)
+}
+
+// ResolvedFood is a food from either the shared database or the user's own
+// custom foods, with its nutrition per 100 g
+type ResolvedFood struct {
+	Name         string             `json:"name"`
+	Description  string             `json:"description"`
+	Source       string             `json:"source"` // "database" or "custom"
+	CustomFoodID uint               `json:"custom_food_id,omitempty"`
+	Per100g      FoodNutrition      `json:"per_100g"`
+	Portions     map[string]float64 `json:"portions,omitempty"` // portion unit -> grams
+}
+
+// resolveFood finds a food by name for a user. The user's custom foods take
+// precedence over the shared database and are never visible to other users.
+func resolveFood(userID uint, name string) (ResolvedFood, bool) {
+	var custom CustomFood
+	if err := DB.Preload("Portions").Where("user_id = ? AND food_key = ?", userID, foodKey(name)).First(&custom).Error; err == nil {
+		return custom.resolved(), true
+	}
+
+	profile, ok := lookupFood(name)
+	if !ok {
+		return ResolvedFood{}, false
+	}
+	return ResolvedFood{
+		Name:        foodKey(name),
+		Description: profile.Description,
+		Source:      "database",
+		Per100g:     profile.NutritionPer100g(),
+	}, true
+}
+
+// grams converts a quantity to grams using the food's own portion units
+// (e.g. "slice") before the generic ones
+func (f ResolvedFood) grams(quantity float64, unit string) (float64, error) {
+	for name, grams := range f.Portions {
+		if strings.EqualFold(name, strings.TrimSpace(unit)) {
+			return quantity * grams, nil
+		}
+	}
+	return gramsFor(quantity, unit)
+}
+
+// GET /foods/search?q=
+// Returns the caller's custom foods followed by the shared database foods.
+func SearchFoods(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	query := foodKey(c.Query("q"))
+
+	pattern := "%" + escapeLike(query) + "%"
+	var customFoods []CustomFood
+	if err := DB.Preload("Portions").Where("user_id = ? AND food_key LIKE ?", userID.(uint), pattern).
+		Order("name").Find(&customFoods).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search custom foods"})
+		return
+	}
+
+	results := []ResolvedFood{}
+	for _, custom := range customFoods {
+		food := custom.resolved()
+		food.Per100g = food.Per100g.rounded()
+		results = append(results, food)
+	}
+
+	var databaseFoods []ResolvedFood
+	for name, profile := range foodNutrientsDB() {
+		if query != "" && !strings.Contains(name, query) {
+			continue
+		}
+		databaseFoods = append(databaseFoods, ResolvedFood{
+			Name:        name,
+			Description: profile.Description,
+			Source:      "database",
+			Per100g:     profile.NutritionPer100g().rounded(),
+		})
+	}
+	sort.Slice(databaseFoods, func(i, j int) bool { return databaseFoods[i].Name < databaseFoods[j].Name })
+	results = append(results, databaseFoods...)
+
+	c.JSON(http.StatusOK, gin.H{"foods": results})
+}
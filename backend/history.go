@@ -1,22 +1,297 @@
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+	maxPagedItems   = 10000 // deepest offset page; the timeline pages further with cursors
 )
 
-type HistoryEntry struct {
-	Timestamp       string  `json:"timestamp"`
-	FoodDescription string  `json:"food_description"`
-	Calories        uint    `json:"calories"`
-	Nutrients       string  `json:"nutrients"`
-	Level           float64 `json:"glucose_level"`
-	MealTag         string  `json:"meal_tag"`
-	MealType        string  `json:"meal_type"`
-	Notes           string  `json:"notes"`
+// TimelineEvent is one entry of the history timeline. Data is the full
+// record of its type: GlucoseReading, DietLog, FluidIntake, Medication,
+// Appointment or Note.
+type TimelineEvent struct {
+	Type      string      `json:"type"` // glucose, meal, fluid, medication, appointment or note
+	ID        uint        `json:"id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+	Tags      []string    `json:"tags"`
+}
+
+// timelineSource loads the newest events of one type. Every source returns at
+// most limit events so a page can be cut from the merged, sorted result.
+type timelineSource struct {
+	eventType string
+	table     string
+	column    string // timestamp column
+	text      string // SQL expression of the searchable text
+	load      func(query *gorm.DB, limit int) ([]TimelineEvent, error)
+	model     interface{}
+}
+
+var timelineSources = []timelineSource{
+	{"glucose", "glucose_readings", "recorded_at", "coalesce(notes, '') || ' ' || coalesce(meal_tag, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []GlucoseReading
+		err := query.Order("recorded_at desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "glucose", ID: row.ID, Timestamp: row.RecordedAt, Data: row}
+		}
+		return events, err
+	}, &GlucoseReading{}},
+	{"meal", "diet_logs", "timestamp", "coalesce(food_description, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []DietLog
+		err := query.Preload("Items").Order("timestamp desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "meal", ID: row.ID, Timestamp: row.Timestamp, Data: row}
+		}
+		return events, err
+	}, &DietLog{}},
+	{"fluid", "fluid_intakes", "recorded_at", "coalesce(name, '') || ' ' || coalesce(notes, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []FluidIntake
+		err := query.Order("recorded_at desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "fluid", ID: row.ID, Timestamp: row.RecordedAt, Data: row}
+		}
+		return events, err
+	}, &FluidIntake{}},
+	{"medication", "medications", "start_date", "coalesce(name, '') || ' ' || coalesce(dosage, '') || ' ' || coalesce(notes, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []Medication
+		err := query.Order("start_date desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "medication", ID: row.ID, Timestamp: row.StartDate, Data: row}
+		}
+		return events, err
+	}, &Medication{}},
+	{"appointment", "appointments", "scheduled_at", "coalesce(purpose, '') || ' ' || coalesce(physician_name, '') || ' ' || coalesce(notes, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []Appointment
+		err := query.Order("scheduled_at desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "appointment", ID: row.ID, Timestamp: row.ScheduledAt, Data: row}
+		}
+		return events, err
+	}, &Appointment{}},
+	{"note", "notes", "recorded_at", "coalesce(text, '')", func(query *gorm.DB, limit int) ([]TimelineEvent, error) {
+		var rows []Note
+		err := query.Order("recorded_at desc, id desc").Limit(limit).Find(&rows).Error
+		events := make([]TimelineEvent, len(rows))
+		for i, row := range rows {
+			events[i] = TimelineEvent{Type: "note", ID: row.ID, Timestamp: row.RecordedAt, Data: row}
+		}
+		return events, err
+	}, &Note{}},
+}
+
+// timelineFilter restricts which events are loaded. Zero values mean no
+// restriction.
+type timelineFilter struct {
+	from, to *time.Time
+	types    map[string]bool
+	query    string // full-text search over the source's text and tags
+	tag      string // exact tag name
+	after    *timelineCursor
+}
+
+// timelineCursor is the position of the last event of a page, in the order
+// of sortTimeline. The next page starts after it, however deep it is.
+type timelineCursor struct {
+	timestamp time.Time
+	eventType string
+	id        uint
+}
+
+func encodeTimelineCursor(event TimelineEvent) string {
+	raw := fmt.Sprintf("%s|%s|%d", event.Timestamp.UTC().Format(time.RFC3339Nano), event.Type, event.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseTimelineCursor(v string) (*timelineCursor, error) {
+	invalid := fmt.Errorf("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, invalid
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	if _, ok := findTimelineSource(parts[1]); !ok {
+		return nil, invalid
+	}
+	id, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	return &timelineCursor{timestamp: timestamp, eventType: parts[1], id: uint(id)}, nil
+}
+
+func (f timelineFilter) scope(userID uint, source timelineSource) *gorm.DB {
+	query := DB.Where(source.table+".user_id = ?", userID)
+	if f.from != nil {
+		query = query.Where(source.column+" >= ? AND "+source.column+" < ?", *f.from, *f.to)
+	}
+	if f.query != "" {
+		query = query.Where("(to_tsvector('english', "+source.text+") @@ plainto_tsquery('english', ?)"+
+			" OR EXISTS (SELECT 1 FROM entry_tags JOIN tags ON tags.id = entry_tags.tag_id"+
+			" WHERE entry_tags.entry_type = ? AND entry_tags.entry_id = "+source.table+".id"+
+			" AND to_tsvector('simple', tags.name) @@ plainto_tsquery('simple', ?)))",
+			f.query, source.eventType, f.query)
+	}
+	if f.tag != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM entry_tags JOIN tags ON tags.id = entry_tags.tag_id"+
+			" WHERE entry_tags.entry_type = ? AND entry_tags.entry_id = "+source.table+".id AND tags.name = ?)",
+			source.eventType, f.tag)
+	}
+	if f.after != nil {
+		// Events of one source sort by timestamp and then ID; sources with
+		// the same timestamp sort by type
+		switch {
+		case source.eventType > f.after.eventType:
+			query = query.Where(source.column+" <= ?", f.after.timestamp)
+		case source.eventType == f.after.eventType:
+			query = query.Where("("+source.column+" < ? OR ("+source.column+" = ? AND "+source.table+".id < ?))",
+				f.after.timestamp, f.after.timestamp, f.after.id)
+		default:
+			query = query.Where(source.column+" < ?", f.after.timestamp)
+		}
+	}
+	return query
 }
 
-// GET /history
+// requestTimelineFilter parses the from, to, tz, type and cursor query
+// parameters shared by the history and search endpoints
+func requestTimelineFilter(c *gin.Context) (timelineFilter, error) {
+	var filter timelineFilter
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := parseTimelineCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.after = cursor
+	}
+	if c.Query("from") != "" || c.Query("to") != "" {
+		loc, err := requestLocation(c)
+		if err != nil {
+			return filter, err
+		}
+		start, end, err := requestDateRange(c, loc, 30)
+		if err != nil {
+			return filter, err
+		}
+		filter.from, filter.to = &start, &end
+	}
+
+	if v := c.Query("type"); v != "" {
+		filter.types = map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if _, ok := findTimelineSource(t); !ok {
+				return filter, fmt.Errorf("unknown event type %q", t)
+			}
+			filter.types[t] = true
+		}
+	}
+	return filter, nil
+}
+
+// loadTimeline returns one page of the user's events matching filter, the
+// total number of matching events and whether more events follow. With a
+// cursor in the filter the page starts after it and page is ignored.
+func loadTimeline(userID uint, filter timelineFilter, page, pageSize int) ([]TimelineEvent, int64, bool, error) {
+	offset := (page - 1) * pageSize
+	if filter.after != nil {
+		offset = 0
+	}
+	events := []TimelineEvent{}
+	var total int64
+	for _, source := range timelineSources {
+		if filter.types != nil && !filter.types[source.eventType] {
+			continue
+		}
+
+		var count int64
+		counted := filter
+		counted.after = nil
+		if err := counted.scope(userID, source).Model(source.model).Count(&count).Error; err != nil {
+			return nil, 0, false, err
+		}
+		total += count
+		if count == 0 {
+			continue
+		}
+
+		// One more than the page to tell whether another page follows
+		loaded, err := source.load(filter.scope(userID, source), offset+pageSize+1)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		events = append(events, loaded...)
+	}
+
+	sortTimeline(events)
+	if offset >= len(events) {
+		return []TimelineEvent{}, total, false, nil
+	}
+	events = events[offset:]
+	hasMore := len(events) > pageSize
+	if hasMore {
+		events = events[:pageSize]
+	}
+	if err := attachTags(userID, events); err != nil {
+		return nil, 0, false, err
+	}
+	return events, total, hasMore, nil
+}
+
+// timelinePage is the response body of a timeline page. next_cursor fetches
+// the following page.
+func timelinePage(key string, events []TimelineEvent, page, pageSize int, total int64, hasMore bool) gin.H {
+	body := gin.H{
+		key:         events,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+		"has_more":  hasMore,
+	}
+	if hasMore {
+		body["next_cursor"] = encodeTimelineCursor(events[len(events)-1])
+	}
+	return body
+}
+
+func findTimelineSource(eventType string) (timelineSource, bool) {
+	for _, source := range timelineSources {
+		if source.eventType == eventType {
+			return source, true
+		}
+	}
+	return timelineSource{}, false
+}
+
+// GET /history?from=YYYY-MM-DD&to=YYYY-MM-DD&tz=Area/City&type=glucose,meal&page_size=50&cursor=...
+// Returns every event of the user, newest first. Without from/to the whole
+// history is paged through by passing the next_cursor of a page as cursor;
+// page=N is accepted for the first pages.
 func GetUserHistory(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -24,29 +299,96 @@ func GetUserHistory(c *gin.Context) {
 		return
 	}
 
-	var diets []DietLog
-	var glucose []GlucoseReading
+	page, pageSize, err := requestPage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := requestTimelineFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, total, hasMore, err := loadTimeline(userID.(uint), filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve history"})
+		return
+	}
 
-	DB.Where("user_id = ?", userID.(uint)).Order("timestamp desc").Find(&diets)
-	DB.Where("user_id = ?", userID.(uint)).Order("recorded_at desc").Find(&glucose)
+	c.JSON(http.StatusOK, timelinePage("history", events, page, pageSize, total, hasMore))
+}
 
-	// Combine entries
-	var history []HistoryEntry
-	for i := 0; i < len(diets) && i < len(glucose); i++ {
-		entry := HistoryEntry{
-			Timestamp:       diets[i].Timestamp.Format("Jan 2 15:04"),
-			FoodDescription: diets[i].FoodDescription,
-			Calories:        diets[i].Calories,
-			Nutrients:       diets[i].Nutrients,
-			Level:           glucose[i].Level,
-			MealTag:         glucose[i].MealTag,
-			MealType:        glucose[i].MealType,
-			Notes:           glucose[i].Notes,
-		}
-		history = append(history, entry)
+// GET /search?q=pizza&tag=exercise&type=meal&from=YYYY-MM-DD&to=YYYY-MM-DD&cursor=...
+// Full-text search over notes, food descriptions and tags. At least one of q
+// and tag is required. Paged like GET /history.
+func SearchHistory(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, pageSize, err := requestPage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := requestTimelineFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.query = strings.TrimSpace(c.Query("q"))
+	filter.tag = normalizeTag(c.Query("tag"))
+	if filter.query == "" && filter.tag == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q or tag is required"})
+		return
+	}
+
+	events, total, hasMore, err := loadTimeline(userID.(uint), filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search history"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"history": history,
+	c.JSON(http.StatusOK, timelinePage("results", events, page, pageSize, total, hasMore))
+}
+
+// sortTimeline orders events newest first. Ties are broken by type and ID so
+// pages stay stable between requests.
+func sortTimeline(events []TimelineEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.After(events[j].Timestamp)
+		}
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+		return events[i].ID > events[j].ID
 	})
 }
+
+// requestPage parses the page (from 1) and page_size query parameters. Pages
+// end at maxPagedItems, since every page loads all the rows before it.
+func requestPage(c *gin.Context) (int, int, error) {
+	page, pageSize := 1, defaultPageSize
+	if v := c.Query("page"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			return 0, 0, fmt.Errorf("page must be a positive number")
+		}
+		page = parsed
+	}
+	if v := c.Query("page_size"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxPageSize {
+			return 0, 0, fmt.Errorf("page_size must be between 1 and %d", maxPageSize)
+		}
+		pageSize = parsed
+	}
+	if page*pageSize > maxPagedItems {
+		return 0, 0, fmt.Errorf("page must be at most %d for page_size %d", maxPagedItems/pageSize, pageSize)
+	}
+	return page, pageSize, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -55,9 +56,11 @@ func ClassifyFoodImage(c *gin.Context) {
 	}
 
 	// Call the AI service to classify the image
-	classificationResponse, err := callAIService(request.Image)
+	ctx, cancel := aiRequestContext(c)
+	defer cancel()
+	classificationResponse, err := callAIService(ctx, request.Image)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to classify image", "details": err.Error()})
+		c.JSON(aiErrorStatus(err), gin.H{"error": "Failed to classify image", "details": err.Error()})
 		return
 	}
 
@@ -69,24 +72,7 @@ func ClassifyFoodImage(c *gin.Context) {
 	}
 
 	// Create a diet log from the classification result with enhanced information
-	description := classificationResponse.Food + ": " + classificationResponse.Description
-	if classificationResponse.DiabetesImpact != "" {
-		description += " - " + classificationResponse.DiabetesImpact
-	}
-	if classificationResponse.PortionSize != "" {
-		description += " (Portion: " + classificationResponse.PortionSize + ")"
-	}
-	if classificationResponse.GlycemicIndex > 0 {
-		description += fmt.Sprintf(" [GI: %d]", classificationResponse.GlycemicIndex)
-	}
-
-	dietLog := DietLog{
-		UserID:          userID.(uint),
-		Timestamp:       time.Now(),
-		FoodDescription: description,
-		Calories:        uint(classificationResponse.Calories),
-		Nutrients:       string(nutrientsJSON),
-	}
+	dietLog := dietLogFromClassification(userID.(uint), classificationResponse, string(nutrientsJSON))
 
 	// Save the diet log to the database
 	if err := DB.Create(&dietLog).Error; err != nil {
@@ -102,20 +88,46 @@ func ClassifyFoodImage(c *gin.Context) {
 	})
 }
 
-// callAIService sends the image to the AI service for classification
-func callAIService(imageBase64 string) (*FoodClassificationResponse, error) {
-	// Log the length of the base64 string
-	fmt.Printf("Image base64 length: %d\n", len(imageBase64))
+// dietLogFromClassification builds a diet log holding the classified food as
+// its single item, so the glycemic index is kept alongside the carbohydrates
+func dietLogFromClassification(userID uint, classification *FoodClassificationResponse, nutrientsJSON string) DietLog {
+	description := classification.Food + ": " + classification.Description
+	if classification.DiabetesImpact != "" {
+		description += " - " + classification.DiabetesImpact
+	}
+	if classification.PortionSize != "" {
+		description += " (Portion: " + classification.PortionSize + ")"
+	}
+	if classification.GlycemicIndex > 0 {
+		description += fmt.Sprintf(" [GI: %d]", classification.GlycemicIndex)
+	}
 
-	// Use only the real AI service with Food-101 dataset
-	fmt.Println("Using only the real AI service with Food-101 dataset...")
-	return callRealAIService(imageBase64)
+	nutrients := parseNutrients(nutrientsJSON)
+	dietLog := DietLog{
+		UserID:          userID,
+		Timestamp:       time.Now(),
+		FoodDescription: description,
+		Calories:        uint(classification.Calories),
+		Nutrients:       nutrientsJSON,
+		Items: []DietLogItem{{
+			FoodName:      classification.Food,
+			Portion:       classification.PortionSize,
+			Quantity:      1,
+			Calories:      uint(classification.Calories),
+			Carbs:         nutrientValue(nutrients, carbohydrateKeys...),
+			Fiber:         nutrientValue(nutrients, fiberKeys...),
+			GlycemicIndex: classification.GlycemicIndex,
+		}},
+	}
+	applyGlycemicLoad(&dietLog)
+	return dietLog
 }
 
-// callRealAIService uses the real AI service with Food-101 dataset
-func callRealAIService(imageBase64 string) (*FoodClassificationResponse, error) {
-	// Prepare the request to the AI service
-	url := "http://localhost:5002/classify" // Use port 5002 for the real service
+// callAIService sends the image to the AI service for classification,
+// retrying transient failures through the classifier's circuit breaker
+func callAIService(ctx context.Context, imageBase64 string) (*FoodClassificationResponse, error) {
+	// Log the length of the base64 string
+	fmt.Printf("Image base64 length: %d\n", len(imageBase64))
 
 	// Check if the image data is valid
 	if len(imageBase64) == 0 {
@@ -149,9 +161,34 @@ func callRealAIService(imageBase64 string) (*FoodClassificationResponse, error)
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
+	// Use only the real AI service with Food-101 dataset
+	fmt.Println("Using only the real AI service with Food-101 dataset...")
+	var classificationResponse *FoodClassificationResponse
+	err = callWithRetry(ctx, classifierBreaker, func(ctx context.Context) error {
+		var err error
+		classificationResponse, err = callRealAIService(ctx, requestBody)
+		return err
+	})
+	return classificationResponse, err
+}
+
+// callRealAIService uses the real AI service with Food-101 dataset. Each call
+// is limited to FOOD_CLASSIFIER_TIMEOUT.
+func callRealAIService(ctx context.Context, requestBody []byte) (*FoodClassificationResponse, error) {
+	// Prepare the request to the AI service
+	url := "http://localhost:5002/classify" // Use port 5002 for the real service
+
+	ctx, cancel := context.WithTimeout(ctx, envDuration("FOOD_CLASSIFIER_TIMEOUT", defaultClassifierTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
 	// Send the request to the AI service
 	fmt.Println("Sending request to real AI service (Food-101)...")
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(requestBody))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		// Check if the service is running
 		fmt.Println("Error connecting to AI service. Make sure the service is running with:")
@@ -163,14 +200,14 @@ func callRealAIService(imageBase64 string) (*FoodClassificationResponse, error)
 			fmt.Println("cd ai_services && ./train_food_model.sh")
 		}
 
-		return nil, fmt.Errorf("failed to call real AI service: %v", err)
+		return nil, fmt.Errorf("failed to call real AI service: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read the response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// Log the response status and body
@@ -190,7 +227,7 @@ func callRealAIService(imageBase64 string) (*FoodClassificationResponse, error)
 				}
 			}
 		}
-		return nil, fmt.Errorf("real AI service returned error: %s", body)
+		return nil, fmt.Errorf("real AI service returned error: %w", &upstreamStatusError{StatusCode: resp.StatusCode, Body: string(body)})
 	}
 
 	// Parse the response
@@ -214,10 +251,48 @@ func callRealAIService(imageBase64 string) (*FoodClassificationResponse, error)
 
 // SubmitImageAndRecommend handles image upload, classification, and recommendation
 func SubmitImageAndRecommend(c *gin.Context) {
+	submission, ok := saveImageSubmission(c)
+	if !ok {
+		return
+	}
+
+	// Call the recommend function with the complete recommendation, passing all of
+	// today's meals (newest first) so the daily glycemic load is in the context
+	recommend(c, imageRecommendationPrompt, todaysMeals(submission.DietLog), []GlucoseReading{submission.Glucose}, submission.Recommendation)
+}
+
+// StreamImageAndRecommend is SubmitImageAndRecommend streaming the
+// recommendation as Server-Sent Events
+func StreamImageAndRecommend(c *gin.Context) {
+	submission, ok := saveImageSubmission(c)
+	if !ok {
+		return
+	}
+
+	saved := gin.H{
+		"glucose":        submission.Glucose,
+		"diet":           submission.DietLog,
+		"classification": submission.Classification,
+	}
+	streamRecommendation(c, imageRecommendationPrompt, saved, todaysMeals(submission.DietLog), []GlucoseReading{submission.Glucose}, submission.Recommendation)
+}
+
+// imageSubmission is what saveImageSubmission stored and derived
+type imageSubmission struct {
+	Glucose        GlucoseReading
+	DietLog        DietLog
+	Classification *FoodClassificationResponse
+	Recommendation string // rule-based
+}
+
+// saveImageSubmission classifies the image, stores the reading and meal and
+// builds the rule-based recommendation. It writes the error response when it
+// fails.
+func saveImageSubmission(c *gin.Context) (imageSubmission, bool) {
 	userID, exists := c.Get("user_id")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+		return imageSubmission{}, false
 	}
 
 	var request struct {
@@ -227,7 +302,7 @@ func SubmitImageAndRecommend(c *gin.Context) {
 
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Log the request
@@ -235,70 +310,65 @@ func SubmitImageAndRecommend(c *gin.Context) {
 	fmt.Printf("Glucose data: %+v\n", request.Glucose)
 
 	// Call the AI service to classify the image
-	classificationResponse, err := callAIService(request.Image)
+	ctx, cancel := aiRequestContext(c)
+	defer cancel()
+	classificationResponse, err := callAIService(ctx, request.Image)
 	if err != nil {
 		fmt.Printf("Error calling AI service: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(aiErrorStatus(err), gin.H{
 			"error":   "Failed to classify image",
 			"details": err.Error(),
 			"message": "Please ensure the AI service is running and the model is trained",
 		})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Convert nutrients map to string for storage
 	nutrientsJSON, err := json.Marshal(classificationResponse.Nutrients)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process nutrients data"})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Save Glucose
+	request.Glucose.ID = 0
 	request.Glucose.UserID = userID.(uint)
 	request.Glucose.RecordedAt = time.Now()
 	if err := DB.Create(&request.Glucose).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save glucose data"})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Create a diet log from the classification result with enhanced information
-	description := classificationResponse.Food + ": " + classificationResponse.Description
-	if classificationResponse.DiabetesImpact != "" {
-		description += " - " + classificationResponse.DiabetesImpact
-	}
-	if classificationResponse.PortionSize != "" {
-		description += " (Portion: " + classificationResponse.PortionSize + ")"
-	}
-	if classificationResponse.GlycemicIndex > 0 {
-		description += fmt.Sprintf(" [GI: %d]", classificationResponse.GlycemicIndex)
-	}
-
-	dietLog := DietLog{
-		UserID:          userID.(uint),
-		Timestamp:       time.Now(),
-		FoodDescription: description,
-		Calories:        uint(classificationResponse.Calories),
-		Nutrients:       string(nutrientsJSON),
-	}
+	dietLog := dietLogFromClassification(userID.(uint), classificationResponse, string(nutrientsJSON))
 
 	// Save the diet log to the database
 	if err := DB.Create(&dietLog).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Get predefined glucose levels from the medical profile
 	var medicalProfile MedicalProfile
 	if err := DB.Where("user_id = ?", userID.(uint)).First(&medicalProfile).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve medical profile"})
-		return
+		return imageSubmission{}, false
 	}
 
 	// Generate a recommendation based on glucose level and diet
 	recommendation := generateCompleteRecommendation(request.Glucose, dietLog, medicalProfile)
+	loc, err := requestLocation(c)
+	if err != nil {
+		loc = time.UTC
+	}
+	recommendation += recentAlcoholWarning(userID.(uint), loc)
 
-	// Call the recommend function with the complete recommendation
-	recommend(c, []DietLog{dietLog}, []GlucoseReading{request.Glucose}, recommendation)
+	return imageSubmission{
+		Glucose:        request.Glucose,
+		DietLog:        dietLog,
+		Classification: classificationResponse,
+		Recommendation: recommendation,
+	}, true
 }
 
 // Base64ToImage decodes a base64 string to an image
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// LLMMessage is one chat message. Role is "system", "user" or "assistant".
+type LLMMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// LLMRequest is a chat completion request independent of the vendor
+type LLMRequest struct {
+	Messages    []LLMMessage
+	Temperature *float32 // the configured temperature when nil
+	JSON        bool     // ask for a JSON object response
+}
+
+// LLMResponse is the completion text with the usage reported by the provider
+type LLMResponse struct {
+	Content          string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// LLMProvider generates chat completions. Implementations must be safe for
+// concurrent use.
+type LLMProvider interface {
+	Name() string
+	Complete(ctx context.Context, req LLMRequest) (LLMResponse, error)
+	// Stream calls onDelta with each piece of text as it is generated and
+	// returns the full response. An error from onDelta aborts the stream.
+	Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (LLMResponse, error)
+}
+
+// LLMConfig is read from the environment at startup
+type LLMConfig struct {
+	Provider    string // openai, openai_compatible or fake
+	Model       string
+	Temperature float32
+	Timeout     time.Duration
+	BaseURL     string // for openai_compatible, e.g. http://localhost:11434/v1 for Ollama
+	APIKey      string
+	// Estimated price in USD per million tokens, for cost accounting
+	PromptPrice     float64
+	CompletionPrice float64
+}
+
+var (
+	llm       LLMProvider
+	llmConfig LLMConfig
+)
+
+// loadLLMConfig reads LLM_PROVIDER, LLM_MODEL, LLM_TEMPERATURE, LLM_TIMEOUT,
+// LLM_BASE_URL, LLM_API_KEY (falling back to OPENAI_API_KEY),
+// LLM_PROMPT_PRICE and LLM_COMPLETION_PRICE
+func loadLLMConfig() (LLMConfig, error) {
+	config := LLMConfig{
+		Provider:    strings.ToLower(os.Getenv("LLM_PROVIDER")),
+		Model:       os.Getenv("LLM_MODEL"),
+		Temperature: 0.7,
+		Timeout:     60 * time.Second,
+		BaseURL:     os.Getenv("LLM_BASE_URL"),
+		APIKey:      os.Getenv("LLM_API_KEY"),
+		// gpt-3.5-turbo pricing
+		PromptPrice:     0.5,
+		CompletionPrice: 1.5,
+	}
+	if config.Provider == "" {
+		config.Provider = "openai"
+	}
+	if config.Model == "" {
+		config.Model = "gpt-3.5-turbo"
+	}
+	if config.APIKey == "" {
+		config.APIKey = os.Getenv("OPENAI_API_KEY")
+	}
+	if v := os.Getenv("LLM_TEMPERATURE"); v != "" {
+		temperature, err := strconv.ParseFloat(v, 32)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return config, fmt.Errorf("LLM_TEMPERATURE must be a number between 0 and 2")
+		}
+		config.Temperature = float32(temperature)
+	}
+	if v := os.Getenv("LLM_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return config, fmt.Errorf("LLM_TIMEOUT must be a positive duration such as 60s")
+		}
+		config.Timeout = timeout
+	}
+	for name, price := range map[string]*float64{"LLM_PROMPT_PRICE": &config.PromptPrice, "LLM_COMPLETION_PRICE": &config.CompletionPrice} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil || parsed < 0 {
+				return config, fmt.Errorf("%s must be a price in USD per million tokens", name)
+			}
+			*price = parsed
+		}
+	}
+	return config, nil
+}
+
+// newLLMProvider builds the provider selected by the configuration
+func newLLMProvider(config LLMConfig) (LLMProvider, error) {
+	switch config.Provider {
+	case "openai":
+		return &openAIProvider{name: "openai", client: openai.NewClient(config.APIKey), config: config}, nil
+	case "openai_compatible":
+		if config.BaseURL == "" {
+			return nil, fmt.Errorf("LLM_BASE_URL is required for the openai_compatible provider")
+		}
+		clientConfig := openai.DefaultConfig(config.APIKey)
+		clientConfig.BaseURL = config.BaseURL
+		return &openAIProvider{name: "openai_compatible", client: openai.NewClientWithConfig(clientConfig), config: config}, nil
+	case "fake":
+		return &fakeLLMProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown LLM_PROVIDER %q (expected openai, openai_compatible or fake)", config.Provider)
+}
+
+// InitLLM sets up the global provider, exiting on invalid configuration
+func InitLLM() {
+	config, err := loadLLMConfig()
+	if err != nil {
+		log.Fatalf("Invalid LLM configuration: %v", err)
+	}
+	provider, err := newLLMProvider(config)
+	if err != nil {
+		log.Fatalf("Invalid LLM configuration: %v", err)
+	}
+	llm, llmConfig = &resilientLLMProvider{provider: provider, breaker: llmBreaker}, config
+	log.Printf("Using LLM provider %s with model %s", provider.Name(), config.Model)
+}
+
+// openAIProvider talks to the OpenAI API or any server implementing it
+type openAIProvider struct {
+	name   string
+	client *openai.Client
+	config LLMConfig
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	resp, err := p.client.CreateChatCompletion(ctx, p.chatRequest(req))
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return LLMResponse{}, fmt.Errorf("model returned no choices")
+	}
+	return LLMResponse{
+		Content:          resp.Choices[0].Message.Content,
+		Model:            resp.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (LLMResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	chatRequest := p.chatRequest(req)
+	chatRequest.Stream = true
+	chatRequest.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	stream, err := p.client.CreateChatCompletionStream(ctx, chatRequest)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+	defer stream.Close()
+
+	var result LLMResponse
+	var content strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return LLMResponse{}, err
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.PromptTokens = chunk.Usage.PromptTokens
+			result.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return LLMResponse{}, err
+		}
+	}
+	result.Content = content.String()
+	return result, nil
+}
+
+func (p *openAIProvider) chatRequest(req LLMRequest) openai.ChatCompletionRequest {
+	temperature := p.config.Temperature
+	if req.Temperature != nil {
+		temperature = *req.Temperature
+	}
+	chatRequest := openai.ChatCompletionRequest{
+		Model:       p.config.Model,
+		Temperature: temperature,
+	}
+	for _, message := range req.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, openai.ChatCompletionMessage{Role: message.Role, Content: message.Content})
+	}
+	if req.JSON {
+		chatRequest.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+	return chatRequest
+}
+
+// fakeLLMProvider is a deterministic offline provider for development and
+// tests. It returns queued responses in order, then a fixed reply.
+type fakeLLMProvider struct {
+	mu        sync.Mutex
+	responses []string
+	requests  []LLMRequest
+}
+
+func (p *fakeLLMProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeLLMProvider) Complete(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return LLMResponse{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, req)
+
+	content := "Keep your meals balanced, choose low glycemic index foods and take a short walk after eating."
+	if req.JSON {
+		content = "{}"
+	}
+	if len(p.responses) > 0 {
+		content = p.responses[0]
+		p.responses = p.responses[1:]
+	}
+
+	var promptWords int
+	for _, message := range req.Messages {
+		promptWords += len(strings.Fields(message.Content))
+	}
+	return LLMResponse{
+		Content:          content,
+		Model:            "fake",
+		PromptTokens:     promptWords,
+		CompletionTokens: len(strings.Fields(content)),
+	}, nil
+}
+
+// Stream sends the reply word by word
+func (p *fakeLLMProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (LLMResponse, error) {
+	resp, err := p.Complete(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	words := strings.SplitAfter(resp.Content, " ")
+	for _, word := range words {
+		if err := onDelta(word); err != nil {
+			return LLMResponse{}, err
+		}
+	}
+	return resp, nil
+}
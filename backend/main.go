@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -32,9 +34,50 @@ func main() {
 		log.Println("Warning: .env file not found, using system environment variables")
 	}
 
+	// One-off maintenance commands
+	importFoods := flag.String("import-foods", "", "import an Open Food Facts style dump (JSONL or CSV) and exit")
+	exportFeedback := flag.String("export-feedback", "", "write the rated recommendations to a JSONL dataset and exit")
+	feedbackSummary := flag.Int("feedback-summary", 0, "print a summary of the ratings of the last N days and exit")
+	flag.Parse()
+
+	if *importFoods != "" {
+		InitDB()
+		stats, err := ImportFoodProducts(*importFoods)
+		if err != nil {
+			log.Fatalf("Food import failed: %v", err)
+		}
+		log.Printf("Food import finished: %d read, %d inserted, %d updated, %d unchanged, %d invalid, %d duplicate",
+			stats.Read, stats.Inserted, stats.Updated, stats.Unchanged, stats.Invalid, stats.Duplicate)
+		return
+	}
+	if *exportFeedback != "" {
+		InitDB()
+		count, err := ExportFeedback(*exportFeedback)
+		if err != nil {
+			log.Fatalf("Feedback export failed: %v", err)
+		}
+		log.Printf("Feedback export finished: %d rated recommendations written to %s", count, *exportFeedback)
+		return
+	}
+	if *feedbackSummary > 0 {
+		InitDB()
+		summaries, err := summarizeFeedback(time.Now().AddDate(0, 0, -*feedbackSummary))
+		if err != nil {
+			log.Fatalf("Feedback summary failed: %v", err)
+		}
+		log.Printf("Feedback summary of the last %d days: %d groups", *feedbackSummary, len(summaries))
+		for _, s := range summaries {
+			log.Printf("source=%s model=%s endpoint=%s prompt_version=%s: %d ratings, %.1f%% helpful, followed %d of %d, reasons %v",
+				s.Source, s.Model, s.Endpoint, s.PromptVersion, s.Ratings, 100*s.HelpfulRate, s.Followed, s.FollowedKnown, s.Reasons)
+		}
+		return
+	}
+
 	// Validate required environment variables
 	validateEnvVars()
 	InitDB()
+	InitLLM()
+	InitPrompts()
 
 	r := gin.Default()
 	r.Use(CORSMiddleware()) // Apply CORS middleware to handle pre-flight requests for all routes
@@ -45,6 +88,7 @@ func main() {
 	r.POST("/submit-data", handleDataSubmission)
 	r.POST("/signup", Signup)
 	r.POST("/verify", VerifyEmail) // Email verification endpoint with code
+	r.GET("/status", GetStatus)    // Circuit breaker state of the AI upstreams
 
 	// Protected routes
 	auth := r.Group("/", AuthMiddleware())
@@ -55,16 +99,79 @@ func main() {
 		auth.GET("/glucose", GetGlucoseData)
 		auth.POST("/glucose", AddGlucoseReading)
 		auth.POST("/set_glucose_levels", SetGlucoseLevels)
+		auth.POST("/nutrition_targets", SetNutritionTargets)
 
 		auth.POST("/diet", AddDietLog)
 		auth.GET("/diet", GetDietLogs)
+		auth.GET("/diet/summary", GetNutritionSummary)
+		auth.PATCH("/diet/:id", UpdateDietLog)
+		auth.DELETE("/diet/:id", DeleteDietLog)
+		auth.GET("/diet/:id/revisions", GetDietLogRevisions)
+
+		// Saved meals and favorites
+		auth.POST("/diet/templates", CreateMealTemplate)
+		auth.GET("/diet/templates", GetMealTemplates)
+		auth.DELETE("/diet/templates/:id", DeleteMealTemplate)
+		auth.POST("/diet/from-template/:id", LogMealFromTemplate)
+		auth.POST("/foods/favorites", AddFavoriteFood)
+		auth.GET("/foods/favorites", GetFavoriteFoods)
+		auth.DELETE("/foods/favorites/:id", DeleteFavoriteFood)
+		auth.GET("/foods/search", SearchFoods)
+		auth.POST("/foods/log", LogFood)
+
+		// Private user-defined foods
+		auth.POST("/foods/custom", CreateCustomFood)
+		auth.GET("/foods/custom", GetCustomFoods)
+		auth.PUT("/foods/custom/:id", UpdateCustomFood)
+		auth.DELETE("/foods/custom/:id", DeleteCustomFood)
+
+		// Home-cooked recipes
+		auth.POST("/recipes", CreateRecipe)
+		auth.GET("/recipes", GetRecipes)
+		auth.GET("/recipes/:id", GetRecipe)
+		auth.PUT("/recipes/:id", UpdateRecipe)
+		auth.DELETE("/recipes/:id", DeleteRecipe)
+		auth.POST("/recipes/:id/log", LogRecipe)
+
+		// Packaged food lookup from the imported product database
+		auth.GET("/foods/barcode/:ean", GetFoodByBarcode)
+		auth.POST("/foods/barcode/:ean", LogFoodByBarcode)
+
+		// Drinks, water and alcohol
+		auth.POST("/fluids", AddFluidIntake)
+		auth.GET("/fluids", GetFluidIntakes)
+		auth.DELETE("/fluids/:id", DeleteFluidIntake)
+		auth.POST("/notes", AddNote)
+		auth.DELETE("/notes/:id", DeleteNote)
+		auth.POST("/meal-plans", CreateMealPlan)
+		auth.GET("/meal-plans", GetMealPlans)
+		auth.GET("/meal-plans/:id", GetMealPlan)
+		auth.GET("/meal-plans/:id/adherence", GetMealPlanAdherence)
+		auth.POST("/meal-plans/:id/meals/:mealId/eaten", MarkPlannedMealEaten)
 
 		auth.POST("/submit_and_recommend", SubmitDataAndRecommend)
+		auth.POST("/submit_and_recommend/stream", StreamDataAndRecommend)
+		auth.GET("/recommendations", GetRecommendations)
+		auth.GET("/recommendations/:id", GetRecommendation)
+		auth.POST("/recommendations/:id/feedback", RateRecommendation)
+		auth.GET("/ai-usage", GetAIUsage)
+		auth.POST("/chat/threads", CreateChatThread)
+		auth.GET("/chat/threads", GetChatThreads)
+		auth.GET("/chat/threads/:id", GetChatThread)
+		auth.DELETE("/chat/threads/:id", DeleteChatThread)
+		auth.POST("/chat/threads/:id/messages", SendChatMessage)
+		auth.POST("/chat/threads/:id/messages/stream", StreamChatMessage)
 		auth.GET("/history", GetUserHistory)
+		auth.GET("/days", GetDays)
+		auth.GET("/search", SearchHistory)
+		auth.GET("/tags", GetTags)
+		auth.POST("/entries/:type/:id/tags", AddEntryTags)
+		auth.DELETE("/entries/:type/:id/tags/:tag", DeleteEntryTag)
 
 		// New image classification endpoints
 		auth.POST("/classify_food_image", ClassifyFoodImage)
 		auth.POST("/submit_image_and_recommend", SubmitImageAndRecommend)
+		auth.POST("/submit_image_and_recommend/stream", StreamImageAndRecommend)
 	}
 
 	port := os.Getenv("PORT")
@@ -109,7 +216,7 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", allowedOrigins)
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		// Add security headers
 		c.Writer.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
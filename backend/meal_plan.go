@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	mealPlanDays = 7
+	// Targets used when the user has not set their own
+	defaultDailyCalories = 2000
+	defaultDailyCarbs    = 180
+	// A planned day may deviate this much from the targets
+	mealPlanTolerance = 0.15
+	// The model gets one more attempt with the list of problems when a plan is invalid
+	mealPlanAttempts = 2
+)
+
+var (
+	// Type 1 diabetes however the profile spells it: "Type 1", "type I", "T1D"
+	type1DiabetesPattern = regexp.MustCompile(`(?i)\b(type[\s-]*(1|i|one)|t1dm?)\b`)
+	// Insulins by generic and brand name
+	insulinPattern = regexp.MustCompile(`(?i)\b(insulin|glargine|lantus|toujeo|basaglar|detemir|levemir|degludec|tresiba|lispro|humalog|aspart|novolog|novorapid|fiasp|glulisine|apidra|humulin|novolin)\b`)
+)
+
+// MealPlan is a generated 7-day plan with its structured days and meals
+type MealPlan struct {
+	ID            uint          `gorm:"primaryKey" json:"id"`
+	UserID        uint          `gorm:"not null;index" json:"user_id"`
+	StartDate     time.Time     `gorm:"not null" json:"start_date"`
+	CalorieTarget float64       `json:"calorie_target"`
+	CarbTarget    float64       `json:"carb_target"`
+	DiabetesType  string        `json:"diabetes_type"`
+	UsesInsulin   bool          `json:"uses_insulin"` // type 1 diabetes or a current insulin medication
+	Dislikes      string        `json:"dislikes"`
+	Notices       []string      `gorm:"serializer:json" json:"notices"` // added by the safety guardrails
+	Days          []MealPlanDay `gorm:"foreignKey:MealPlanID;constraint:OnDelete:CASCADE" json:"days"`
+	CreatedAt     time.Time     `json:"created_at"`
+}
+
+// MealPlanDay is one day of a MealPlan
+type MealPlanDay struct {
+	ID         uint          `gorm:"primaryKey" json:"id"`
+	MealPlanID uint          `gorm:"not null;index" json:"meal_plan_id"`
+	DayNumber  int           `json:"day_number"` // 1 to 7
+	Date       time.Time     `json:"date"`
+	Meals      []PlannedMeal `gorm:"foreignKey:MealPlanDayID;constraint:OnDelete:CASCADE" json:"meals"`
+}
+
+// PlannedMeal is a meal of a plan day. Marking it eaten creates a diet log.
+type PlannedMeal struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	MealPlanDayID uint       `gorm:"not null;index" json:"meal_plan_day_id"`
+	MealType      string     `json:"meal_type"`
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Calories      float64    `json:"calories"`
+	Carbs         float64    `json:"carbs"`
+	Protein       float64    `json:"protein"`
+	Fat           float64    `json:"fat"`
+	EatenAt       *time.Time `json:"eaten_at"`
+	DietLogID     *uint      `json:"diet_log_id"`
+}
+
+// generatedPlan is the JSON shape the model is asked to produce
+type generatedPlan struct {
+	Days []struct {
+		Day   int `json:"day"`
+		Meals []struct {
+			MealType    string  `json:"meal_type"`
+			Name        string  `json:"name"`
+			Description string  `json:"description"`
+			Calories    float64 `json:"calories"`
+			Carbs       float64 `json:"carbs"`
+			Protein     float64 `json:"protein"`
+			Fat         float64 `json:"fat"`
+		} `json:"meals"`
+	} `json:"days"`
+}
+
+// POST /meal-plans
+func CreateMealPlan(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		StartDate string   `json:"start_date"` // YYYY-MM-DD, defaults to tomorrow
+		Dislikes  []string `json:"dislikes"`   // defaults to the profile's food dislikes
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var medicalProfile MedicalProfile
+	if err := DB.Where("user_id = ?", userID.(uint)).First(&medicalProfile).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve medical profile"})
+		return
+	}
+
+	now := time.Now()
+	startDate := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	if input.StartDate != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", input.StartDate, now.Location())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date (expected YYYY-MM-DD)"})
+			return
+		}
+		startDate = parsed
+	}
+
+	plan := MealPlan{
+		UserID:        userID.(uint),
+		StartDate:     startDate,
+		CalorieTarget: medicalProfile.DailyCalorieTarget,
+		CarbTarget:    medicalProfile.DailyCarbTarget,
+		DiabetesType:  medicalProfile.DiabetesType,
+		UsesInsulin:   usesInsulin(userID.(uint), medicalProfile.DiabetesType),
+		Dislikes:      medicalProfile.FoodDislikes,
+	}
+	if plan.CalorieTarget == 0 {
+		plan.CalorieTarget = defaultDailyCalories
+	}
+	if plan.CarbTarget == 0 {
+		plan.CarbTarget = defaultDailyCarbs
+	}
+	if input.Dislikes != nil {
+		plan.Dislikes = joinDislikes(input.Dislikes)
+	}
+
+	if !reserveAIQuota(c, plan.UserID) {
+		return
+	}
+	ctx, cancel := aiRequestContext(c)
+	defer cancel()
+	generated, err := generateMealPlan(ctx, plan)
+	if err != nil {
+		fmt.Println("Meal plan generation error:", err)
+		status := aiErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, gin.H{"error": "Failed to generate meal plan"})
+		return
+	}
+
+	// The plan is not about a current reading, so only the rules for any
+	// reading apply, such as removing dosing advice
+	guard := newGuardrail(nil)
+	for i, day := range generated.Days {
+		planDay := MealPlanDay{DayNumber: i + 1, Date: startDate.AddDate(0, 0, i)}
+		for _, meal := range day.Meals {
+			mealType, _ := normalizeMealType(meal.MealType)
+			name := strings.TrimSpace(guard.filter(meal.Name))
+			if name == "" {
+				continue
+			}
+			planDay.Meals = append(planDay.Meals, PlannedMeal{
+				MealType:    mealType,
+				Name:        name,
+				Description: strings.TrimSpace(guard.filter(meal.Description)),
+				Calories:    round1(meal.Calories),
+				Carbs:       round1(meal.Carbs),
+				Protein:     round1(meal.Protein),
+				Fat:         round1(meal.Fat),
+			})
+		}
+		plan.Days = append(plan.Days, planDay)
+	}
+	plan.Notices = guard.notices()
+
+	if err := DB.Create(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save meal plan"})
+		return
+	}
+	for i := range guard.violations {
+		guard.violations[i].MealPlanID = plan.ID
+		guard.violations[i].UserID = plan.UserID
+		fmt.Printf("Guardrail violation on meal plan %d: %s %q\n", plan.ID, guard.violations[i].Rule, guard.violations[i].Excerpt)
+	}
+	if len(guard.violations) > 0 {
+		if err := DB.Create(&guard.violations).Error; err != nil {
+			fmt.Println("Error saving guardrail violations:", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Meal plan created", "meal_plan": plan})
+}
+
+// generateMealPlan asks the model for a plan and validates it against the
+// targets and dislikes, retrying once with the problems it found
+func generateMealPlan(ctx context.Context, plan MealPlan) (generatedPlan, error) {
+	messages := []LLMMessage{
+		{
+			Role: "system",
+			Content: "You are a dietitian specialised in diabetes. You create practical weekly meal plans. " +
+				"Respond only with JSON of the form {\"days\":[{\"day\":1,\"meals\":[{\"meal_type\":\"breakfast|lunch|dinner|snack\"," +
+				"\"name\":\"...\",\"description\":\"...\",\"calories\":0,\"carbs\":0,\"protein\":0,\"fat\":0}]}]} " +
+				"where calories are kcal and carbs, protein and fat are grams. " + userDataInstruction,
+		},
+		{
+			Role:    "user",
+			Content: buildMealPlanPrompt(plan),
+		},
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < mealPlanAttempts; attempt++ {
+		resp, err := llm.Complete(ctx, LLMRequest{Messages: messages, JSON: true})
+		if err != nil {
+			return generatedPlan{}, err
+		}
+		recordAIUsage(plan.UserID, resp.PromptTokens, resp.CompletionTokens)
+		content := resp.Content
+
+		var generated generatedPlan
+		problems := []string{}
+		if err := json.Unmarshal([]byte(content), &generated); err != nil {
+			problems = append(problems, "the response was not valid JSON: "+err.Error())
+		} else {
+			problems = validateMealPlan(generated, plan)
+		}
+		if len(problems) == 0 {
+			return generated, nil
+		}
+
+		lastErr = fmt.Errorf("invalid meal plan: %s", strings.Join(problems, "; "))
+		messages = append(messages,
+			LLMMessage{Role: "assistant", Content: content},
+			LLMMessage{Role: "user", Content: "Please fix these problems and return the full corrected plan: " + strings.Join(problems, "; ")},
+		)
+	}
+	return generatedPlan{}, lastErr
+}
+
+func buildMealPlanPrompt(plan MealPlan) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Create a %d-day meal plan for a person with %s diabetes.\n", mealPlanDays, plan.DiabetesType))
+	sb.WriteString(fmt.Sprintf("Each day must total about %.0f kcal and %.0f g of carbohydrates (within %.0f%%).\n",
+		plan.CalorieTarget, plan.CarbTarget, mealPlanTolerance*100))
+	sb.WriteString("Every day needs a breakfast, a lunch and a dinner, snacks are optional. Spread carbohydrates evenly across the meals and prefer low glycemic index foods.\n")
+	if dislikes := splitDislikes(plan.Dislikes); len(dislikes) > 0 {
+		sanitizer := &promptSanitizer{}
+		for i, dislike := range dislikes {
+			dislikes[i] = sanitizer.clean("food_dislikes", dislike, maxPromptNameLength)
+		}
+		sb.WriteString("Never include these foods: " + userDataOpen + strings.Join(dislikes, ", ") + userDataClose + ".\n")
+	}
+	if plan.UsesInsulin {
+		sb.WriteString("The person uses insulin, keep the carbohydrate amount of each meal consistent from day to day so it is easy to count.\n")
+	}
+	return sb.String()
+}
+
+// usesInsulin reports whether the user has type 1 diabetes or a current
+// medication that is an insulin
+func usesInsulin(userID uint, diabetesType string) bool {
+	if type1DiabetesPattern.MatchString(diabetesType) {
+		return true
+	}
+	var medications []Medication
+	DB.Where("user_id = ? AND (end_date IS NULL OR end_date > ?)", userID, time.Now()).Find(&medications)
+	for _, medication := range medications {
+		if insulinPattern.MatchString(medication.Name + " " + medication.Notes) {
+			return true
+		}
+	}
+	return false
+}
+
+// dislikePattern matches a disliked food as whole words, also in the plural,
+// so "pea" finds "peas" but not "peanut" or "pear"
+func dislikePattern(dislike string) *regexp.Regexp {
+	words := strings.Fields(regexp.QuoteMeta(dislike))
+	return regexp.MustCompile(`(?i)\b` + strings.Join(words, `\s+`) + `(e?s)?\b`)
+}
+
+// validateMealPlan lists everything that makes a generated plan unusable
+func validateMealPlan(generated generatedPlan, plan MealPlan) []string {
+	problems := []string{}
+	if len(generated.Days) != mealPlanDays {
+		problems = append(problems, fmt.Sprintf("the plan must have exactly %d days, got %d", mealPlanDays, len(generated.Days)))
+	}
+
+	var dislikes []*regexp.Regexp
+	for _, dislike := range splitDislikes(plan.Dislikes) {
+		dislikes = append(dislikes, dislikePattern(dislike))
+	}
+	for i, day := range generated.Days {
+		var calories, carbs float64
+		mainMeals := map[string]bool{}
+		for _, meal := range day.Meals {
+			mealType, err := normalizeMealType(meal.MealType)
+			if err != nil || mealType == "" || meal.Name == "" {
+				problems = append(problems, fmt.Sprintf("day %d has a meal without a valid meal_type or name", i+1))
+				continue
+			}
+			mainMeals[mealType] = true
+			calories += meal.Calories
+			carbs += meal.Carbs
+
+			text := meal.Name + " " + meal.Description
+			for _, dislike := range dislikes {
+				if found := dislike.FindString(text); found != "" {
+					problems = append(problems, fmt.Sprintf("day %d %s contains %s which the user dislikes", i+1, mealType, strings.ToLower(found)))
+				}
+			}
+		}
+		for _, required := range []string{"breakfast", "lunch", "dinner"} {
+			if !mainMeals[required] {
+				problems = append(problems, fmt.Sprintf("day %d has no %s", i+1, required))
+			}
+		}
+		if math.Abs(calories-plan.CalorieTarget) > plan.CalorieTarget*mealPlanTolerance {
+			problems = append(problems, fmt.Sprintf("day %d totals %.0f kcal instead of about %.0f", i+1, calories, plan.CalorieTarget))
+		}
+		if math.Abs(carbs-plan.CarbTarget) > plan.CarbTarget*mealPlanTolerance {
+			problems = append(problems, fmt.Sprintf("day %d totals %.0f g carbs instead of about %.0f", i+1, carbs, plan.CarbTarget))
+		}
+	}
+	return problems
+}
+
+// GET /meal-plans
+func GetMealPlans(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var plans []MealPlan
+	if err := DB.Where("user_id = ?", userID.(uint)).Order("start_date desc").Find(&plans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve meal plans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"meal_plans": plans})
+}
+
+// GET /meal-plans/:id
+func GetMealPlan(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	plan, err := findMealPlan(userID.(uint), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meal plan not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"meal_plan": plan})
+}
+
+// POST /meal-plans/:id/meals/:mealId/eaten
+// Creates a diet log from the planned meal. The body may carry a timestamp.
+func MarkPlannedMealEaten(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	timestamp, err := mealTimestamp(input.Timestamp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var meal PlannedMeal
+	err = DB.Joins("JOIN meal_plan_days ON meal_plan_days.id = planned_meals.meal_plan_day_id").
+		Joins("JOIN meal_plans ON meal_plans.id = meal_plan_days.meal_plan_id").
+		Where("planned_meals.id = ? AND meal_plans.id = ? AND meal_plans.user_id = ?", c.Param("mealId"), c.Param("id"), userID.(uint)).
+		First(&meal).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Planned meal not found"})
+		return
+	}
+	if meal.DietLogID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Meal already marked as eaten"})
+		return
+	}
+
+	dietLog := DietLog{
+		UserID:          userID.(uint),
+		Timestamp:       timestamp,
+		FoodDescription: meal.Name + ": " + meal.Description,
+		Calories:        uint(math.Round(meal.Calories)),
+		Nutrients: nutrientsString(map[string]float64{
+			"carbohydrates": meal.Carbs,
+			"protein":       meal.Protein,
+			"fat":           meal.Fat,
+		}),
+		MealType: meal.MealType,
+	}
+	applyGlycemicLoad(&dietLog)
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&dietLog).Error; err != nil {
+			return err
+		}
+		meal.EatenAt = &timestamp
+		meal.DietLogID = &dietLog.ID
+		return tx.Model(&meal).Updates(map[string]interface{}{"eaten_at": timestamp, "diet_log_id": dietLog.ID}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Meal marked as eaten",
+		"planned_meal": meal,
+		"diet_log":     dietLog,
+	})
+}
+
+// GET /meal-plans/:id/adherence
+// Compares the plan with what was marked eaten and with everything logged on
+// each plan day.
+func GetMealPlanAdherence(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	plan, err := findMealPlan(userID.(uint), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meal plan not found"})
+		return
+	}
+
+	end := plan.StartDate.AddDate(0, 0, mealPlanDays)
+	var logs []DietLog
+	DB.Where("user_id = ? AND timestamp >= ? AND timestamp < ?", userID.(uint), plan.StartDate, end).Find(&logs)
+	actual := map[string]*NutritionTotals{}
+	for _, meal := range logs {
+		date := meal.Timestamp.In(plan.StartDate.Location()).Format("2006-01-02")
+		if actual[date] == nil {
+			actual[date] = &NutritionTotals{}
+		}
+		actual[date].add(meal)
+	}
+
+	type dayAdherence struct {
+		DayNumber       int     `json:"day_number"`
+		Date            string  `json:"date"`
+		PlannedMeals    int     `json:"planned_meals"`
+		EatenMeals      int     `json:"eaten_meals"`
+		PlannedCalories float64 `json:"planned_calories"`
+		PlannedCarbs    float64 `json:"planned_carbs"`
+		ActualCalories  float64 `json:"actual_calories"`
+		ActualCarbs     float64 `json:"actual_carbs"`
+	}
+	days := []dayAdherence{}
+	planned, eaten := 0, 0
+	for _, day := range plan.Days {
+		date := day.Date.In(plan.StartDate.Location()).Format("2006-01-02")
+		d := dayAdherence{DayNumber: day.DayNumber, Date: date, PlannedMeals: len(day.Meals)}
+		for _, meal := range day.Meals {
+			d.PlannedCalories += meal.Calories
+			d.PlannedCarbs += meal.Carbs
+			if meal.DietLogID != nil {
+				d.EatenMeals++
+			}
+		}
+		if totals := actual[date]; totals != nil {
+			d.ActualCalories = round1(totals.Calories)
+			d.ActualCarbs = round1(totals.Carbs)
+		}
+		d.PlannedCalories = round1(d.PlannedCalories)
+		d.PlannedCarbs = round1(d.PlannedCarbs)
+		planned += d.PlannedMeals
+		eaten += d.EatenMeals
+		days = append(days, d)
+	}
+
+	var percent float64
+	if planned > 0 {
+		percent = round1(float64(eaten) / float64(planned) * 100)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"meal_plan_id":      plan.ID,
+		"planned_meals":     planned,
+		"eaten_meals":       eaten,
+		"adherence_percent": percent,
+		"days":              days,
+	})
+}
+
+func findMealPlan(userID uint, id string) (MealPlan, error) {
+	var plan MealPlan
+	err := DB.Preload("Days", func(db *gorm.DB) *gorm.DB { return db.Order("day_number") }).
+		Preload("Days.Meals").
+		Where("id = ? AND user_id = ?", id, userID).First(&plan).Error
+	return plan, err
+}
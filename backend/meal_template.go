@@ -0,0 +1,356 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MealTemplate is a named, reusable meal ("my usual breakfast") that can be
+// logged again with one call. Items carry the default portions.
+type MealTemplate struct {
+	ID              uint               `gorm:"primaryKey" json:"id"`
+	UserID          uint               `gorm:"not null;index" json:"user_id"`
+	Name            string             `gorm:"not null" json:"name"`
+	FoodDescription string             `json:"food_description"`
+	Calories        uint               `json:"calories"`
+	Nutrients       string             `json:"nutrients"`
+	UseCount        int                `gorm:"default:0" json:"use_count"`
+	LastUsedAt      *time.Time         `json:"last_used_at"`
+	Items           []MealTemplateItem `gorm:"foreignKey:MealTemplateID;constraint:OnDelete:CASCADE" json:"items"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+}
+
+// MealTemplateItem mirrors DietLogItem, Quantity being the default portion count
+type MealTemplateItem struct {
+	ID             uint    `gorm:"primaryKey" json:"id"`
+	MealTemplateID uint    `gorm:"not null;index" json:"meal_template_id"`
+	FoodName       string  `json:"food_name"`
+	Portion        string  `json:"portion"`
+	Quantity       float64 `gorm:"default:1" json:"quantity"`
+	Calories       uint    `json:"calories"`
+	Carbs          float64 `json:"carbs"`
+	Fiber          float64 `json:"fiber"`
+	GlycemicIndex  int     `json:"glycemic_index"`
+}
+
+// FavoriteFood is a food the user marked for quick access
+type FavoriteFood struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	UserID        uint      `gorm:"not null;uniqueIndex:idx_favorite_user_food" json:"user_id"`
+	FoodName      string    `gorm:"not null;uniqueIndex:idx_favorite_user_food" json:"food_name"`
+	Portion       string    `json:"portion"`
+	Calories      uint      `json:"calories"`
+	Carbs         float64   `json:"carbs"`
+	Fiber         float64   `json:"fiber"`
+	GlycemicIndex int       `json:"glycemic_index"`
+	LogCount      int64     `gorm:"-" json:"log_count"` // times the food appears in the user's diet log
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// POST /diet/templates
+// Either copies an existing diet entry (diet_log_id) or saves the given items.
+func CreateMealTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Name            string             `json:"name" binding:"required"`
+		DietLogID       uint               `json:"diet_log_id"`
+		FoodDescription string             `json:"food_description"`
+		Calories        uint               `json:"calories"`
+		Nutrients       string             `json:"nutrients"`
+		Items           []MealTemplateItem `json:"items"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template := MealTemplate{
+		UserID:          userID.(uint),
+		Name:            strings.TrimSpace(input.Name),
+		FoodDescription: input.FoodDescription,
+		Calories:        input.Calories,
+		Nutrients:       input.Nutrients,
+		Items:           input.Items,
+	}
+
+	if input.DietLogID != 0 {
+		var source DietLog
+		if err := DB.Preload("Items").Where("id = ? AND user_id = ?", input.DietLogID, userID.(uint)).First(&source).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Diet log not found"})
+			return
+		}
+		template.FoodDescription = source.FoodDescription
+		template.Calories = source.Calories
+		template.Nutrients = source.Nutrients
+		template.Items = nil
+		for _, item := range source.Items {
+			template.Items = append(template.Items, MealTemplateItem{
+				FoodName:      item.FoodName,
+				Portion:       item.Portion,
+				Quantity:      item.Quantity,
+				Calories:      item.Calories,
+				Carbs:         item.Carbs,
+				Fiber:         item.Fiber,
+				GlycemicIndex: item.GlycemicIndex,
+			})
+		}
+	}
+
+	if template.FoodDescription == "" {
+		names := make([]string, 0, len(template.Items))
+		for _, item := range template.Items {
+			names = append(names, item.FoodName)
+		}
+		template.FoodDescription = strings.Join(names, ", ")
+	}
+	if template.FoodDescription == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A template needs a diet_log_id, a food_description or items"})
+		return
+	}
+	for i := range template.Items {
+		template.Items[i].ID = 0
+		if template.Items[i].Quantity <= 0 {
+			template.Items[i].Quantity = 1
+		}
+	}
+	if template.Calories == 0 {
+		for _, item := range template.Items {
+			template.Calories += uint(math.Round(float64(item.Calories) * item.Quantity))
+		}
+	}
+
+	if err := DB.Create(&template).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save meal template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Meal template saved",
+		"template": template,
+	})
+}
+
+// GET /diet/templates
+// Most used templates come first so the usual meals surface at the top.
+func GetMealTemplates(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var templates []MealTemplate
+	if err := DB.Preload("Items").Where("user_id = ?", userID.(uint)).
+		Order("use_count desc").Order("last_used_at desc nulls last").Order("name").
+		Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve meal templates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+// DELETE /diet/templates/:id
+func DeleteMealTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&MealTemplate{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete meal template"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meal template not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Meal template deleted"})
+}
+
+// POST /diet/from-template/:id
+// Logs the template as a new diet entry. The body is optional: servings scales
+// the default portions and timestamp backdates the meal.
+func LogMealFromTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Servings  float64    `json:"servings"`
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if input.Servings < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Servings must be positive"})
+		return
+	}
+	if input.Servings == 0 {
+		input.Servings = 1
+	}
+
+	timestamp, err := mealTimestamp(input.Timestamp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var template MealTemplate
+	if err := DB.Preload("Items").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&template).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meal template not found"})
+		return
+	}
+
+	dietLog := DietLog{
+		UserID:          userID.(uint),
+		Timestamp:       timestamp,
+		FoodDescription: template.FoodDescription,
+		Calories:        uint(math.Round(float64(template.Calories) * input.Servings)),
+		Nutrients:       scaleNutrients(template.Nutrients, input.Servings),
+	}
+	for _, item := range template.Items {
+		dietLog.Items = append(dietLog.Items, DietLogItem{
+			FoodName:      item.FoodName,
+			Portion:       item.Portion,
+			Quantity:      item.Quantity * input.Servings,
+			Calories:      item.Calories,
+			Carbs:         item.Carbs,
+			Fiber:         item.Fiber,
+			GlycemicIndex: item.GlycemicIndex,
+		})
+	}
+	applyGlycemicLoad(&dietLog)
+
+	if err := DB.Create(&dietLog).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
+		return
+	}
+
+	now := time.Now()
+	template.UseCount++
+	template.LastUsedAt = &now
+	DB.Model(&template).Updates(map[string]interface{}{"use_count": template.UseCount, "last_used_at": now})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Diet log saved",
+		"data":    dietLog,
+	})
+}
+
+// POST /foods/favorites
+func AddFavoriteFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input FavoriteFood
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.ID = 0
+	input.UserID = userID.(uint)
+	input.FoodName = strings.TrimSpace(input.FoodName)
+	if input.FoodName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "food_name is required"})
+		return
+	}
+
+	var existing FavoriteFood
+	if err := DB.Where("user_id = ? AND food_name = ?", input.UserID, input.FoodName).First(&existing).Error; err == nil {
+		c.JSON(http.StatusOK, gin.H{"message": "Food already in favorites", "favorite": existing})
+		return
+	}
+
+	if err := DB.Create(&input).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Food added to favorites", "favorite": input})
+}
+
+// GET /foods/favorites
+// Ranked by how often each food appears in the user's diet log.
+func GetFavoriteFoods(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var favorites []FavoriteFood
+	if err := DB.Where("user_id = ?", userID.(uint)).Order("food_name").Find(&favorites).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve favorites"})
+		return
+	}
+
+	var counts []struct {
+		FoodName string
+		Count    int64
+	}
+	DB.Table("diet_log_items").
+		Select("lower(diet_log_items.food_name) AS food_name, count(*) AS count").
+		Joins("JOIN diet_logs ON diet_logs.id = diet_log_items.diet_log_id").
+		Where("diet_logs.user_id = ? AND diet_logs.deleted_at IS NULL", userID.(uint)).
+		Group("lower(diet_log_items.food_name)").
+		Scan(&counts)
+	frequency := make(map[string]int64, len(counts))
+	for _, row := range counts {
+		frequency[row.FoodName] = row.Count
+	}
+
+	for i := range favorites {
+		favorites[i].LogCount = frequency[strings.ToLower(favorites[i].FoodName)]
+	}
+	// Stable sort keeps the alphabetical order for foods logged equally often
+	sort.SliceStable(favorites, func(i, j int) bool {
+		return favorites[i].LogCount > favorites[j].LogCount
+	})
+
+	c.JSON(http.StatusOK, gin.H{"favorites": favorites})
+}
+
+// DELETE /foods/favorites/:id
+func DeleteFavoriteFood(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&FavoriteFood{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete favorite"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Favorite not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Favorite removed"})
+}
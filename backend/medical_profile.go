@@ -1,6 +1,12 @@
 package main
 
-import "time"
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
 
 type MedicalProfile struct {
     ID                    uint      `gorm:"primaryKey"`
@@ -11,4 +17,66 @@ type MedicalProfile struct {
     PreferredUnit         string    `gorm:"default:'mg/dL'"`
     FastingBloodGlucose   float64   `json:"fasting_blood_glucose"` // fasting glucose level
     PostprandialGlucose   float64   `json:"postprandial_glucose"`  // post-meal glucose level
+    DailyCalorieTarget    float64   `json:"daily_calorie_target"`  // kcal per day, 0 when not set
+    DailyCarbTarget       float64   `json:"daily_carb_target"`     // grams of carbohydrate per day, 0 when not set
+    FoodDislikes          string    `json:"food_dislikes"`         // comma-separated foods to avoid in meal plans
+}
+
+// POST /nutrition_targets
+func SetNutritionTargets(c *gin.Context) {
+    userID, exists := c.Get("user_id")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
+        return
+    }
+
+    var input struct {
+        DailyCalorieTarget float64  `json:"daily_calorie_target"`
+        DailyCarbTarget    float64  `json:"daily_carb_target"`
+        FoodDislikes       []string `json:"food_dislikes"` // left unchanged when omitted
+    }
+    if err := c.ShouldBindJSON(&input); err != nil || input.DailyCalorieTarget < 0 || input.DailyCarbTarget < 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+        return
+    }
+
+    var medicalProfile MedicalProfile
+    if err := DB.Where("user_id = ?", userID.(uint)).First(&medicalProfile).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Medical profile not found, set your glucose levels first"})
+        return
+    }
+
+    medicalProfile.DailyCalorieTarget = input.DailyCalorieTarget
+    medicalProfile.DailyCarbTarget = input.DailyCarbTarget
+    if input.FoodDislikes != nil {
+        medicalProfile.FoodDislikes = joinDislikes(input.FoodDislikes)
+    }
+    if err := DB.Save(&medicalProfile).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save nutrition targets"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Nutrition targets saved successfully"})
+}
+
+// joinDislikes normalizes a list of disliked foods for storage
+func joinDislikes(dislikes []string) string {
+    var cleaned []string
+    for _, d := range dislikes {
+        if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+            cleaned = append(cleaned, d)
+        }
+    }
+    return strings.Join(cleaned, ", ")
+}
+
+// splitDislikes is the inverse of joinDislikes
+func splitDislikes(dislikes string) []string {
+    var result []string
+    for _, d := range strings.Split(dislikes, ",") {
+        if d = strings.TrimSpace(d); d != "" {
+            result = append(result, d)
+        }
+    }
+    return result
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Note is a free-text journal entry that isn't attached to a reading or meal,
+// e.g. "felt dizzy after the run"
+type Note struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	UserID     uint      `gorm:"not null;index" json:"user_id"`
+	RecordedAt time.Time `gorm:"not null;index" json:"recorded_at"`
+	Text       string    `gorm:"not null" json:"text"`
+}
+
+// POST /notes
+func AddNote(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Text       string     `json:"text" binding:"required"`
+		RecordedAt *time.Time `json:"recorded_at"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordedAt, err := mealTimestamp(input.RecordedAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	note := Note{
+		UserID:     userID.(uint),
+		RecordedAt: recordedAt,
+		Text:       strings.TrimSpace(input.Text),
+	}
+	if err := DB.Create(&note).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save note"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Note saved", "data": note})
+}
+
+// DELETE /notes/:id
+func DeleteNote(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&Note{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete note"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Note not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Note deleted"})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+// Nutrient keys differ between sources: the enhanced classifier database uses
+// short names while the USDA-derived food_nutrients_db.json uses FDC names.
+var (
+	carbohydrateKeys = []string{"carbohydrates", "carbohydrate,_by_difference", "carbs"}
+	fiberKeys        = []string{"fiber", "fiber,_total_dietary"}
+	sugarKeys        = []string{"sugar", "total_sugars", "sugars"}
+	proteinKeys      = []string{"protein", "proteins"}
+	fatKeys          = []string{"fat", "total_lipid_(fat)"}
+)
+
+// parseNutrients decodes the JSON nutrients string stored on diet logs.
+// Free-text nutrients (typed by hand) yield an empty map.
+func parseNutrients(nutrients string) map[string]float64 {
+	values := map[string]float64{}
+	if strings.TrimSpace(nutrients) == "" {
+		return values
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(nutrients), &raw); err != nil {
+		return values
+	}
+	for key, value := range raw {
+		if f, ok := toFloat(value); ok {
+			values[strings.ToLower(key)] = f
+		}
+	}
+	return values
+}
+
+// nutrientValue returns the first of keys present in the map
+func nutrientValue(values map[string]float64, keys ...string) float64 {
+	for _, key := range keys {
+		if v, ok := values[key]; ok {
+			return v
+		}
+	}
+	return 0
+}
+
+// availableCarbs is total carbohydrate minus dietary fiber, the part that
+// actually raises blood glucose
+func availableCarbs(carbs, fiber float64) float64 {
+	return math.Max(carbs-fiber, 0)
+}
+
+// glycemicLoad computes GL = GI x available carbohydrate (g) / 100.
+// A GI of zero means unknown and yields a load of zero.
+func glycemicLoad(glycemicIndex int, carbs, fiber float64) float64 {
+	if glycemicIndex <= 0 {
+		return 0
+	}
+	return round1(float64(glycemicIndex) * availableCarbs(carbs, fiber) / 100)
+}
+
+// glycemicLoadCategory uses the conventional per-meal thresholds
+func glycemicLoadCategory(load float64) string {
+	switch {
+	case load >= 20:
+		return "high"
+	case load > 10:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// scaleNutrients multiplies every value of a JSON nutrients string. Free-text
+// nutrients cannot be scaled and are returned unchanged.
+func scaleNutrients(nutrients string, factor float64) string {
+	if factor == 1 {
+		return nutrients
+	}
+	values := parseNutrients(nutrients)
+	if len(values) == 0 {
+		return nutrients
+	}
+	for key, value := range values {
+		values[key] = round1(value * factor)
+	}
+	scaled, err := json.Marshal(values)
+	if err != nil {
+		return nutrients
+	}
+	return string(scaled)
+}
+
+// nutrientsString encodes a nutrients map in the JSON form stored on diet logs
+func nutrientsString(values map[string]float64) string {
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Prompt templates live in PROMPT_TEMPLATE_DIR, one file per template and
+// version named <template>.<version>.tmpl (e.g. recommendation_text.v6.tmpl).
+// Each file defines a "system" and a "user" template.
+const (
+	imageRecommendationPrompt = "recommendation_image"
+	textRecommendationPrompt  = "recommendation_text"
+	chatPrompt                = "chat"
+	chatPromptVersion         = "v1" // chat isn't part of the A/B assignment
+	defaultPromptVersion      = "v6"
+	defaultPromptExperiment   = "recommendation-prompt"
+)
+
+// promptTemplate is one version of a prompt
+type promptTemplate struct {
+	Name    string
+	Version string
+	tmpl    *template.Template
+}
+
+// promptVars are the variables available to the templates. Everything in them
+// has already been cleaned by the prompt sanitizer.
+type promptVars struct {
+	UserData        string // the user's data, enclosed in the user data delimiters
+	FoodName        string // the meal just logged or photographed, "" when unknown
+	DataInstruction string // tells the model to treat the user data only as data
+	OutputFormat    string // the JSON shape of the structured recommendation
+	Question        string // the user's chat message
+}
+
+var (
+	promptTemplates  map[string]map[string]*promptTemplate // by name, then version
+	promptVersions   []string                              // versions users are split between
+	promptExperiment string                                // salt of the A/B assignment
+)
+
+// InitPrompts loads the prompt templates and the A/B configuration
+func InitPrompts() {
+	dir := os.Getenv("PROMPT_TEMPLATE_DIR")
+	if dir == "" {
+		dir = "prompts"
+	}
+	templates, err := loadPromptTemplates(dir)
+	if err != nil {
+		log.Fatalf("Invalid prompt templates: %v", err)
+	}
+	versions, err := parsePromptVersions(os.Getenv("PROMPT_VERSIONS"), templates)
+	if err != nil {
+		log.Fatalf("Invalid prompt templates: %v", err)
+	}
+	if templates[chatPrompt][chatPromptVersion] == nil {
+		log.Fatalf("Invalid prompt templates: no %s template for version %s", chatPrompt, chatPromptVersion)
+	}
+	promptTemplates, promptVersions = templates, versions
+	promptExperiment = os.Getenv("PROMPT_EXPERIMENT")
+	if promptExperiment == "" {
+		promptExperiment = defaultPromptExperiment
+	}
+	log.Printf("Using prompt versions %s from %s", strings.Join(versions, ", "), dir)
+}
+
+// loadPromptTemplates parses every template file in dir
+func loadPromptTemplates(dir string) (map[string]map[string]*promptTemplate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no prompt templates in %s", dir)
+	}
+
+	templates := map[string]map[string]*promptTemplate{}
+	for _, file := range files {
+		name, version, ok := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".tmpl"), ".")
+		if !ok || name == "" || version == "" {
+			return nil, fmt.Errorf("%s: file name must be <template>.<version>.tmpl", file)
+		}
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range []string{"system", "user"} {
+			if tmpl.Lookup(part) == nil {
+				return nil, fmt.Errorf("%s: missing {{define %q}}", file, part)
+			}
+		}
+		if templates[name] == nil {
+			templates[name] = map[string]*promptTemplate{}
+		}
+		templates[name][version] = &promptTemplate{Name: name, Version: version, tmpl: tmpl}
+	}
+	return templates, nil
+}
+
+// parsePromptVersions reads the comma-separated PROMPT_VERSIONS. Every version
+// must exist for both the image and the text recommendation.
+func parsePromptVersions(value string, templates map[string]map[string]*promptTemplate) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		value = defaultPromptVersion
+	}
+	var versions []string
+	for _, version := range strings.Split(value, ",") {
+		version = strings.TrimSpace(version)
+		if version == "" {
+			continue
+		}
+		for _, name := range []string{imageRecommendationPrompt, textRecommendationPrompt} {
+			if templates[name][version] == nil {
+				return nil, fmt.Errorf("PROMPT_VERSIONS: no %s template for version %s (have %s)",
+					name, version, strings.Join(templateVersions(templates[name]), ", "))
+			}
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// templateVersions lists the versions of a template in order
+func templateVersions(versions map[string]*promptTemplate) []string {
+	var list []string
+	for version := range versions {
+		list = append(list, version)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// promptFor picks the version of a template a user gets. Users are split
+// evenly between PROMPT_VERSIONS by a hash of their ID, so a user keeps the
+// same version across requests and restarts until the experiment changes.
+func promptFor(name string, userID uint) *promptTemplate {
+	version := promptVersions[0]
+	if len(promptVersions) > 1 {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s:%d", promptExperiment, userID)
+		version = promptVersions[h.Sum32()%uint32(len(promptVersions))]
+	}
+	return promptTemplates[name][version]
+}
+
+// render returns the system and user messages
+func (p *promptTemplate) render(vars promptVars) (string, string, error) {
+	var system, user strings.Builder
+	if err := p.tmpl.ExecuteTemplate(&system, "system", vars); err != nil {
+		return "", "", fmt.Errorf("prompt %s %s: %w", p.Name, p.Version, err)
+	}
+	if err := p.tmpl.ExecuteTemplate(&user, "user", vars); err != nil {
+		return "", "", fmt.Errorf("prompt %s %s: %w", p.Name, p.Version, err)
+	}
+	return strings.TrimSpace(system.String()), strings.TrimSpace(user.String()) + "\n", nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Recipe is a home-cooked dish built from ingredient lines. The per-serving
+// nutrition is computed when the recipe is saved; logging a serving copies
+// those values into the diet log, so later edits never change past meals.
+type Recipe struct {
+	ID            uint               `gorm:"primaryKey" json:"id"`
+	UserID        uint               `gorm:"not null;index" json:"user_id"`
+	Name          string             `gorm:"not null" json:"name"`
+	Servings      float64            `gorm:"not null" json:"servings"`
+	Notes         string             `json:"notes"`
+	Calories      float64            `json:"calories"` // per serving
+	Carbs         float64            `json:"carbs"`
+	Fiber         float64            `json:"fiber"`
+	Sugar         float64            `json:"sugar"`
+	Protein       float64            `json:"protein"`
+	Fat           float64            `json:"fat"`
+	GlycemicIndex int                `json:"glycemic_index"` // carb-weighted average of the ingredients
+	Ingredients   []RecipeIngredient `gorm:"foreignKey:RecipeID;constraint:OnDelete:CASCADE" json:"ingredients"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+// RecipeIngredient is one line of a recipe with its computed contribution
+type RecipeIngredient struct {
+	ID       uint    `gorm:"primaryKey" json:"id"`
+	RecipeID uint    `gorm:"not null;index" json:"recipe_id"`
+	Food     string  `gorm:"not null" json:"food"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"` // g, kg, oz, serving or a custom food portion unit
+	Calories float64 `json:"calories"`
+	Carbs    float64 `json:"carbs"`
+	Fiber    float64 `json:"fiber"`
+}
+
+type recipeInput struct {
+	Name        string  `json:"name" binding:"required"`
+	Servings    float64 `json:"servings" binding:"required,gt=0"`
+	Notes       string  `json:"notes"`
+	Ingredients []struct {
+		Food     string  `json:"food" binding:"required"`
+		Quantity float64 `json:"quantity" binding:"required,gt=0"`
+		Unit     string  `json:"unit"`
+	} `json:"ingredients" binding:"required,min=1,dive"`
+}
+
+// buildRecipe resolves every ingredient against the user's custom foods and
+// the food database, and computes the nutrition per serving
+func buildRecipe(userID uint, input recipeInput) (Recipe, error) {
+	recipe := Recipe{
+		UserID:   userID,
+		Name:     strings.TrimSpace(input.Name),
+		Servings: input.Servings,
+		Notes:    input.Notes,
+	}
+
+	var total FoodNutrition
+	var weightedGI, availableTotal float64
+	var unknown []string
+	for _, line := range input.Ingredients {
+		food, ok := resolveFood(userID, line.Food)
+		if !ok {
+			unknown = append(unknown, line.Food)
+			continue
+		}
+		unit := line.Unit
+		if unit == "" {
+			unit = "g"
+		}
+		grams, err := food.grams(line.Quantity, unit)
+		if err != nil {
+			return Recipe{}, err
+		}
+
+		nutrition := food.Per100g.scaled(grams / 100)
+		total.Calories += nutrition.Calories
+		total.Carbs += nutrition.Carbs
+		total.Fiber += nutrition.Fiber
+		total.Sugar += nutrition.Sugar
+		total.Protein += nutrition.Protein
+		total.Fat += nutrition.Fat
+
+		// GL is linear in available carbs, so weighting GI by them keeps the
+		// recipe's glycemic load equal to the sum of its ingredients'
+		if nutrition.GlycemicIndex > 0 {
+			available := availableCarbs(nutrition.Carbs, nutrition.Fiber)
+			weightedGI += float64(nutrition.GlycemicIndex) * available
+			availableTotal += available
+		}
+
+		recipe.Ingredients = append(recipe.Ingredients, RecipeIngredient{
+			Food:     foodKey(line.Food),
+			Quantity: line.Quantity,
+			Unit:     unit,
+			Calories: round1(nutrition.Calories),
+			Carbs:    round1(nutrition.Carbs),
+			Fiber:    round1(nutrition.Fiber),
+		})
+	}
+	if len(unknown) > 0 {
+		return Recipe{}, fmt.Errorf("unknown foods: %s", strings.Join(unknown, ", "))
+	}
+
+	perServing := total.scaled(1 / recipe.Servings).rounded()
+	recipe.Calories = perServing.Calories
+	recipe.Carbs = perServing.Carbs
+	recipe.Fiber = perServing.Fiber
+	recipe.Sugar = perServing.Sugar
+	recipe.Protein = perServing.Protein
+	recipe.Fat = perServing.Fat
+	if availableTotal > 0 {
+		recipe.GlycemicIndex = int(math.Round(weightedGI / availableTotal))
+	}
+	return recipe, nil
+}
+
+// POST /recipes
+func CreateRecipe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input recipeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recipe, err := buildRecipe(userID.(uint), input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := DB.Create(&recipe).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save recipe"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Recipe saved", "recipe": recipe})
+}
+
+// GET /recipes
+func GetRecipes(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var recipes []Recipe
+	if err := DB.Preload("Ingredients").Where("user_id = ?", userID.(uint)).Order("name").Find(&recipes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve recipes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recipes": recipes})
+}
+
+// GET /recipes/:id
+func GetRecipe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var recipe Recipe
+	if err := DB.Preload("Ingredients").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&recipe).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recipe": recipe})
+}
+
+// PUT /recipes/:id replaces the recipe and its ingredients
+func UpdateRecipe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var existing Recipe
+	if err := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&existing).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	var input recipeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recipe, err := buildRecipe(userID.(uint), input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recipe.ID = existing.ID
+	recipe.CreatedAt = existing.CreatedAt
+	for i := range recipe.Ingredients {
+		recipe.Ingredients[i].RecipeID = existing.ID
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("recipe_id = ?", existing.ID).Delete(&RecipeIngredient{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&recipe.Ingredients).Error; err != nil {
+			return err
+		}
+		return tx.Omit("Ingredients").Save(&recipe).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update recipe"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Recipe updated", "recipe": recipe})
+}
+
+// DELETE /recipes/:id
+func DeleteRecipe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).Delete(&Recipe{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recipe"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Recipe deleted"})
+}
+
+// POST /recipes/:id/log logs servings of the recipe as a diet entry
+func LogRecipe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Servings  float64    `json:"servings"`
+		Timestamp *time.Time `json:"timestamp"`
+		MealType  string     `json:"meal_type"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if input.Servings < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Servings must be positive"})
+		return
+	}
+	if input.Servings == 0 {
+		input.Servings = 1
+	}
+	timestamp, err := mealTimestamp(input.Timestamp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mealType, err := normalizeMealType(input.MealType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var recipe Recipe
+	if err := DB.Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&recipe).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	nutrients := map[string]float64{
+		"carbohydrates": round1(recipe.Carbs * input.Servings),
+		"fiber":         round1(recipe.Fiber * input.Servings),
+		"sugar":         round1(recipe.Sugar * input.Servings),
+		"protein":       round1(recipe.Protein * input.Servings),
+		"fat":           round1(recipe.Fat * input.Servings),
+	}
+
+	dietLog := DietLog{
+		UserID:          userID.(uint),
+		Timestamp:       timestamp,
+		FoodDescription: fmt.Sprintf("%s (%g serving(s), homemade)", recipe.Name, input.Servings),
+		Calories:        uint(math.Round(recipe.Calories * input.Servings)),
+		Nutrients:       nutrientsString(nutrients),
+		MealType:        mealType,
+		Items: []DietLogItem{{
+			FoodName:      recipe.Name,
+			Portion:       "1 serving",
+			Quantity:      input.Servings,
+			Calories:      uint(math.Round(recipe.Calories)),
+			Carbs:         recipe.Carbs,
+			Fiber:         recipe.Fiber,
+			GlycemicIndex: recipe.GlycemicIndex,
+		}},
+	}
+	applyGlycemicLoad(&dietLog)
+
+	if err := DB.Create(&dietLog).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diet log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Diet log saved",
+		"data":    dietLog,
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Used when RECOMMENDATION_CACHE_TTL is not set
+const defaultRecommendationCacheTTL = 10 * time.Minute
+
+// Recommendation is an AI recommendation together with everything that
+// produced it
+type Recommendation struct {
+	ID                 uint                      `gorm:"primaryKey" json:"id"`
+	UserID             uint                      `gorm:"not null;index" json:"user_id"`
+	Endpoint           string                    `json:"endpoint"`
+	GlucoseReadingID   *uint                     `json:"glucose_reading_id"`
+	DietLogID          *uint                     `json:"diet_log_id"`
+	RuleRecommendation string                    `json:"rule_recommendation"`               // rule-based text the prompt was built on
+	Source             string                    `gorm:"not null;default:ai" json:"source"` // ai, or rules when the LLM failed or is disabled
+	PromptTemplate     string                    `json:"prompt_template"`
+	PromptVersion      string                    `json:"prompt_version"` // template version, compared across A/B assignments
+	Context            string                    `json:"context"`        // assembled patient context included in the prompt
+	SystemPrompt       string                    `json:"-"`
+	Prompt             string                    `json:"prompt"`
+	InputHash          string                    `gorm:"index" json:"-"` // identifies identical submissions for the cache
+	InjectionFlags     string                    `json:"-"`              // user text removed from the prompt as a likely injection
+	Provider           string                    `json:"provider"`
+	Model              string                    `json:"model"`
+	PromptTokens       int                       `json:"prompt_tokens"`
+	CompletionTokens   int                       `json:"completion_tokens"`
+	LatencyMS          int64                     `json:"latency_ms"`
+	Attempts           int                       `json:"attempts"` // model calls until the output matched the schema
+	Output             string                    `json:"output"`   // text the user received, after the safety guardrails
+	Structured         *StructuredRecommendation `gorm:"serializer:json" json:"structured"`
+	RawOutput          string                    `json:"-"`                        // the model's unfiltered output of the last attempt
+	Error              string                    `json:"-"`                        // why the LLM failed; a rules recommendation was returned instead
+	CachedFromID       *uint                     `json:"cached_from_id,omitempty"` // recommendation whose output was reused for this submission
+	Feedback           *RecommendationFeedback   `json:"feedback,omitempty"`
+	CreatedAt          time.Time                 `gorm:"index" json:"created_at"`
+}
+
+// newRecommendation assembles the context and renders the user's version of
+// the named prompt template for the triggering reading and meal. The first
+// glucose reading and diet log are the ones just submitted.
+func newRecommendation(c *gin.Context, promptName string, diets []DietLog, glucose []GlucoseReading, ruleRecommendation string) (Recommendation, error) {
+	userID, _ := c.Get("user_id")
+	prompt := promptFor(promptName, userID.(uint))
+	record := Recommendation{
+		UserID:             userID.(uint),
+		Endpoint:           c.FullPath(),
+		RuleRecommendation: ruleRecommendation,
+		PromptTemplate:     prompt.Name,
+		PromptVersion:      prompt.Version,
+		Provider:           llm.Name(),
+		Model:              llmConfig.Model,
+	}
+
+	var exclude []uint
+	for _, reading := range glucose {
+		exclude = append(exclude, reading.ID)
+	}
+	// The reading and meal are saved already, so an unknown time zone falls
+	// back to UTC instead of failing the request
+	loc, err := requestLocation(c)
+	if err != nil {
+		loc = time.UTC
+	}
+	sanitizer := &promptSanitizer{}
+	record.Context = assembleContext(record.UserID, exclude, contextTokenBudget(), loc, sanitizer)
+	system, user, err := prompt.render(buildPromptVars(diets, glucose, ruleRecommendation, record.Context, sanitizer))
+	if err != nil {
+		return record, err
+	}
+	record.SystemPrompt, record.Prompt = system, user
+	if len(sanitizer.flags) > 0 {
+		record.InjectionFlags = strings.Join(sanitizer.flags, "; ")
+		fmt.Printf("Possible prompt injection from user %d: %s\n", record.UserID, record.InjectionFlags)
+	}
+
+	if len(glucose) > 0 && glucose[0].ID != 0 {
+		record.GlucoseReadingID = &glucose[0].ID
+	}
+	if len(diets) > 0 && diets[0].ID != 0 {
+		record.DietLogID = &diets[0].ID
+	}
+	record.InputHash = recommendationInputHash(record, diets, glucose)
+	return record, nil
+}
+
+// recommendationInputHash identifies a submission for the cache: the same
+// reading and meal under the same prompt and rule-based assessment
+func recommendationInputHash(record Recommendation, diets []DietLog, glucose []GlucoseReading) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", record.PromptTemplate, record.PromptVersion, record.RuleRecommendation)
+	if len(glucose) > 0 {
+		fmt.Fprintf(h, "\x00%.1f\x00%s\x00%s", glucose[0].Level, glucose[0].MealTag, glucose[0].Notes)
+	}
+	if len(diets) > 0 {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00%.1f\x00%s", diets[0].FoodDescription, diets[0].Calories, diets[0].Carbs, diets[0].Nutrients)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recommendationCacheTTL is how long a recommendation is reused for identical
+// submissions, 0 disables the cache
+func recommendationCacheTTL() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("RECOMMENDATION_CACHE_TTL")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultRecommendationCacheTTL
+}
+
+// cachedRecommendation finds a recent successful LLM recommendation of the
+// user for the same input
+func cachedRecommendation(record Recommendation) (Recommendation, bool) {
+	var cached Recommendation
+	ttl := recommendationCacheTTL()
+	if ttl == 0 {
+		return cached, false
+	}
+	err := DB.Where("user_id = ? AND input_hash = ? AND source = ? AND error = '' AND created_at >= ?",
+		record.UserID, record.InputHash, recommendationSourceAI, time.Now().Add(-ttl)).
+		Order("created_at desc").First(&cached).Error
+	return cached, err == nil && cached.Structured != nil
+}
+
+// reuseRecommendation gives the record of a new submission the output of a
+// cached recommendation. No model was called for it, so it has no tokens,
+// latency or attempts of its own.
+func reuseRecommendation(record *Recommendation, cached Recommendation) {
+	record.Source = cached.Source
+	record.Provider, record.Model = cached.Provider, cached.Model
+	record.Output, record.Structured, record.RawOutput = cached.Output, cached.Structured, cached.RawOutput
+	record.CachedFromID = &cached.ID
+	if cached.CachedFromID != nil {
+		record.CachedFromID = cached.CachedFromID
+	}
+}
+
+// recommendationCursor is the position of the last recommendation of a page,
+// in the order created_at desc, id desc
+type recommendationCursor struct {
+	createdAt time.Time
+	id        uint
+}
+
+func encodeRecommendationCursor(r Recommendation) string {
+	raw := fmt.Sprintf("%s|%d", r.CreatedAt.UTC().Format(time.RFC3339Nano), r.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseRecommendationCursor(v string) (*recommendationCursor, error) {
+	invalid := fmt.Errorf("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, invalid
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	return &recommendationCursor{createdAt: createdAt, id: uint(id)}, nil
+}
+
+// GET /recommendations?page_size=50&cursor=...
+// Newest first. Every recommendation is reached by passing the next_cursor of
+// a page as cursor; page=N is accepted for the first pages.
+func GetRecommendations(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, pageSize, err := requestPage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var after *recommendationCursor
+	if v := c.Query("cursor"); v != "" {
+		if after, err = parseRecommendationCursor(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var total int64
+	var recommendations []Recommendation
+	query := DB.Model(&Recommendation{}).Where("user_id = ? AND (error = '' OR source = ?)", userID.(uint), recommendationSourceRules)
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve recommendations"})
+		return
+	}
+	if after != nil {
+		query = query.Where("(created_at < ? OR (created_at = ? AND id < ?))", after.createdAt, after.createdAt, after.id)
+	} else {
+		query = query.Offset((page - 1) * pageSize)
+	}
+	// One more than the page to tell whether another page follows
+	if err := query.Preload("Feedback").Order("created_at desc, id desc").Limit(pageSize + 1).
+		Find(&recommendations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve recommendations"})
+		return
+	}
+	hasMore := len(recommendations) > pageSize
+	if hasMore {
+		recommendations = recommendations[:pageSize]
+	}
+
+	body := gin.H{
+		"recommendations": recommendations,
+		"page":            page,
+		"page_size":       pageSize,
+		"total":           total,
+		"has_more":        hasMore,
+	}
+	if hasMore {
+		body["next_cursor"] = encodeRecommendationCursor(recommendations[len(recommendations)-1])
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// GET /recommendations/:id
+func GetRecommendation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var recommendation Recommendation
+	if err := DB.Preload("Feedback").Where("id = ? AND user_id = ?", c.Param("id"), userID.(uint)).First(&recommendation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recommendation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recommendation": recommendation})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How far back readings and meals are summarised for the model
+	contextLookback = 7 * 24 * time.Hour
+	// Most recent individual readings listed before they are only summarised
+	contextRecentReadings = 20
+	// Used when RECOMMENDATION_CONTEXT_TOKENS is not set
+	defaultContextTokens = 1200
+)
+
+// contextSection is one titled block of the assembled context. Sections are
+// added in priority order; when the budget runs out the later lines of a
+// section are dropped first, then whole sections.
+type contextSection struct {
+	title string
+	lines []string
+}
+
+// contextTokenBudget is the token budget of the assembled context
+func contextTokenBudget() int {
+	if v, err := strconv.Atoi(os.Getenv("RECOMMENDATION_CONTEXT_TOKENS")); err == nil && v > 0 {
+		return v
+	}
+	return defaultContextTokens
+}
+
+// estimateTokens approximates the token count of English text, about four
+// characters per token
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// assembleContext describes the user's profile, active medications and the
+// last week of readings and meals, within the token budget. exclude lists
+// glucose reading IDs that are already in the prompt. Times and days are in
+// the user's location. Text the user typed is cleaned by sanitizer.
+func assembleContext(userID uint, exclude []uint, budget int, loc *time.Location, sanitizer *promptSanitizer) string {
+	now := time.Now()
+	var sections []contextSection
+
+	var user User
+	var profile MedicalProfile
+	DB.Select("id", "dob", "gender").First(&user, userID)
+	if DB.Where("user_id = ?", userID).First(&profile).Error == nil {
+		lines := []string{"Diabetes type: " + sanitizer.clean("diabetes_type", profile.DiabetesType, maxPromptNameLength)}
+		if !user.DOB.IsZero() {
+			lines = append(lines, fmt.Sprintf("Age: %d", yearsBetween(user.DOB, now)))
+		}
+		if user.Gender != "" {
+			lines = append(lines, "Gender: "+sanitizer.clean("gender", user.Gender, maxPromptNameLength))
+		}
+		if !profile.DiagnosisDate.IsZero() {
+			lines = append(lines, fmt.Sprintf("Diagnosed %d years ago", yearsBetween(profile.DiagnosisDate, now)))
+		}
+		lines = append(lines, fmt.Sprintf("Personal glucose thresholds: fasting %.0f mg/dL, postprandial %.0f mg/dL",
+			profile.FastingBloodGlucose, profile.PostprandialGlucose))
+		if profile.DailyCarbTarget > 0 || profile.DailyCalorieTarget > 0 {
+			lines = append(lines, fmt.Sprintf("Daily targets: %.0f g carbohydrates, %.0f kcal", profile.DailyCarbTarget, profile.DailyCalorieTarget))
+		}
+		if profile.FoodDislikes != "" {
+			lines = append(lines, "Dislikes: "+sanitizer.clean("food_dislikes", profile.FoodDislikes, maxPromptFieldLength))
+		}
+		sections = append(sections, contextSection{"Patient profile", lines})
+	}
+
+	var medications []Medication
+	DB.Where("user_id = ? AND start_date <= ? AND (end_date IS NULL OR end_date > ?)", userID, now, now).
+		Order("start_date desc").Find(&medications)
+	if len(medications) > 0 {
+		var lines []string
+		for _, medication := range medications {
+			line := sanitizer.clean("medication", medication.Name, maxPromptNameLength)
+			if medication.Dosage != "" {
+				line += " " + sanitizer.clean("dosage", medication.Dosage, maxPromptNameLength)
+			}
+			if medication.Notes != "" {
+				line += " (" + sanitizer.clean("medication_notes", medication.Notes, maxPromptFieldLength) + ")"
+			}
+			lines = append(lines, line)
+		}
+		sections = append(sections, contextSection{"Current medications", lines})
+	}
+
+	var readings []GlucoseReading
+	DB.Where("user_id = ? AND recorded_at >= ?", userID, now.Add(-contextLookback)).Order("recorded_at desc").Find(&readings)
+	if len(readings) > 0 {
+		sections = append(sections, contextSection{"Glucose over the last 7 days", glucoseStatistics(readings)})
+
+		skip := map[uint]bool{}
+		for _, id := range exclude {
+			skip[id] = true
+		}
+		var lines []string
+		for _, reading := range readings {
+			if skip[reading.ID] || len(lines) == contextRecentReadings {
+				continue
+			}
+			line := fmt.Sprintf("%s: %.1f mg/dL", reading.RecordedAt.In(loc).Format("Jan 2 15:04"), reading.Level)
+			if reading.MealTag != "" {
+				line += " (" + sanitizer.clean("meal_tag", reading.MealTag, maxPromptNameLength) + ")"
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) > 0 {
+			sections = append(sections, contextSection{"Earlier glucose readings", lines})
+		}
+	}
+
+	var meals []DietLog
+	DB.Where("user_id = ? AND timestamp >= ?", userID, now.Add(-contextLookback)).Order("timestamp desc").Find(&meals)
+	if len(meals) > 0 {
+		var dates []string
+		daily := map[string]*NutritionTotals{}
+		counts := map[string]int{}
+		for _, meal := range meals {
+			date := meal.Timestamp.In(loc).Format("Jan 2")
+			if daily[date] == nil {
+				daily[date] = &NutritionTotals{}
+				dates = append(dates, date)
+			}
+			daily[date].add(meal)
+			counts[date]++
+		}
+		var lines []string
+		for _, date := range dates {
+			totals := daily[date]
+			lines = append(lines, fmt.Sprintf("%s: %d meals, %.0f g carbohydrates, %.0f kcal, glycemic load %.0f",
+				date, counts[date], totals.Carbs, totals.Calories, totals.GlycemicLoad))
+		}
+		sections = append(sections, contextSection{"Daily intake over the last 7 days", lines})
+	}
+
+	return renderContext(sections, budget)
+}
+
+// renderContext writes the sections until the token budget is used up
+func renderContext(sections []contextSection, budget int) string {
+	var sb strings.Builder
+	used := 0
+	for _, section := range sections {
+		header := section.title + ":\n"
+		if used+estimateTokens(header) >= budget {
+			break
+		}
+		var written int
+		for _, line := range section.lines {
+			text := "- " + line + "\n"
+			if used+estimateTokens(header)+estimateTokens(text) > budget {
+				break
+			}
+			if written == 0 {
+				sb.WriteString(header)
+				used += estimateTokens(header)
+			}
+			sb.WriteString(text)
+			used += estimateTokens(text)
+			written++
+		}
+		if written == 0 {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// glucoseStatistics summarises readings for the context
+func glucoseStatistics(readings []GlucoseReading) []string {
+	var sum float64
+	lowest, highest := readings[0].Level, readings[0].Level
+	var inRange, lows, highs int
+	for _, reading := range readings {
+		sum += reading.Level
+		if reading.Level < lowest {
+			lowest = reading.Level
+		}
+		if reading.Level > highest {
+			highest = reading.Level
+		}
+		switch {
+		case reading.Level < targetRangeLow:
+			lows++
+		case reading.Level > targetRangeHigh:
+			highs++
+		default:
+			inRange++
+		}
+	}
+	count := float64(len(readings))
+	return []string{
+		fmt.Sprintf("%d readings, mean %.0f mg/dL, lowest %.0f, highest %.0f", len(readings), sum/count, lowest, highest),
+		fmt.Sprintf("Time in range (%d-%d mg/dL): %.0f%%, %d readings below, %d above",
+			targetRangeLow, targetRangeHigh, float64(inRange)/count*100, lows, highs),
+	}
+}
+
+// yearsBetween returns the number of whole years from start to end
+func yearsBetween(start, end time.Time) int {
+	years := end.Year() - start.Year()
+	if end.YearDay() < start.YearDay() {
+		years--
+	}
+	return years
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxFeedbackCommentLength = 1000
+
+// Reason codes a rating may carry
+var feedbackReasons = map[string]bool{
+	"accurate":       true,
+	"easy_to_follow": true,
+	"personalized":   true,
+	"not_relevant":   true,
+	"too_generic":    true,
+	"hard_to_follow": true,
+	"incorrect":      true,
+	"unsafe":         true,
+	"disliked_food":  true,
+}
+
+// RecommendationFeedback is a user's rating of a recommendation. The
+// recommendation keeps the text, prompt and inputs it was rated on.
+type RecommendationFeedback struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	RecommendationID uint      `gorm:"not null;uniqueIndex" json:"recommendation_id"`
+	UserID           uint      `gorm:"not null;index" json:"user_id"`
+	Helpful          bool      `json:"helpful"`
+	Reasons          []string  `gorm:"serializer:json" json:"reasons"` // codes from feedbackReasons
+	Comment          string    `json:"comment"`
+	Followed         *bool     `json:"followed"` // nil until the user says whether they followed the advice
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `gorm:"index" json:"updated_at"`
+}
+
+// FeedbackSummary aggregates the ratings of one group of recommendations
+type FeedbackSummary struct {
+	Source        string         `json:"source"`
+	Model         string         `json:"model"`
+	Endpoint      string         `json:"endpoint"`
+	PromptVersion string         `json:"prompt_version"`
+	Ratings       int            `json:"ratings"`
+	Helpful       int            `json:"helpful"`
+	HelpfulRate   float64        `json:"helpful_rate"`   // share of helpful ratings, 0 to 1
+	FollowedKnown int            `json:"followed_known"` // ratings that say whether the advice was followed
+	Followed      int            `json:"followed"`
+	Reasons       map[string]int `json:"reasons"`
+}
+
+// FeedbackExample is one line of the exported feedback dataset
+type FeedbackExample struct {
+	RecommendationID uint                      `json:"recommendation_id"`
+	Endpoint         string                    `json:"endpoint"`
+	Source           string                    `json:"source"`
+	Provider         string                    `json:"provider"`
+	Model            string                    `json:"model"`
+	PromptTemplate   string                    `json:"prompt_template"`
+	PromptVersion    string                    `json:"prompt_version"`
+	RuleAssessment   string                    `json:"rule_assessment"`
+	Input            FeedbackInput             `json:"input"`
+	Output           string                    `json:"output"`
+	Structured       *StructuredRecommendation `json:"structured"`
+	Helpful          bool                      `json:"helpful"`
+	Reasons          []string                  `json:"reasons"`
+	Comment          string                    `json:"comment"`
+	Followed         *bool                     `json:"followed"`
+	RecommendedAt    time.Time                 `json:"recommended_at"`
+	RatedAt          time.Time                 `json:"rated_at"`
+}
+
+// FeedbackInput is the reading and meal a recommendation was made for,
+// without the user's notes or exact times
+type FeedbackInput struct {
+	GlucoseReadingID *uint    `json:"glucose_reading_id"`
+	GlucoseLevel     *float64 `json:"glucose_level"` // mg/dL
+	GlucoseMealTag   string   `json:"glucose_meal_tag"`
+	DietLogID        *uint    `json:"diet_log_id"`
+	Food             string   `json:"food"`
+	MealType         string   `json:"meal_type"`
+	Calories         *uint    `json:"calories"`
+	Carbs            *float64 `json:"carbs"`         // g
+	GlycemicLoad     *float64 `json:"glycemic_load"` // nil when a food's glycemic index is unknown
+	Hour             *int     `json:"hour"`          // hour of day of the reading, UTC
+}
+
+// POST /recommendations/:id/feedback rates a recommendation. Rating it again
+// changes only the fields sent, so whether the advice was followed can be
+// added later.
+func RateRecommendation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input struct {
+		Helpful  *bool    `json:"helpful"`
+		Reasons  []string `json:"reasons"`
+		Comment  *string  `json:"comment"`
+		Followed *bool    `json:"followed"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, reason := range input.Reasons {
+		if !feedbackReasons[reason] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown reason %q", reason)})
+			return
+		}
+	}
+	if input.Comment != nil && utf8.RuneCountInString(*input.Comment) > maxFeedbackCommentLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Comment must be at most %d characters", maxFeedbackCommentLength)})
+		return
+	}
+
+	var recommendation Recommendation
+	if err := DB.Where("id = ? AND user_id = ? AND (error = '' OR source = ?)", c.Param("id"), userID.(uint), recommendationSourceRules).
+		First(&recommendation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recommendation not found"})
+		return
+	}
+
+	feedback := RecommendationFeedback{RecommendationID: recommendation.ID, UserID: userID.(uint), Reasons: []string{}}
+	isNew := DB.Where("recommendation_id = ?", recommendation.ID).First(&feedback).Error != nil
+	if isNew && input.Helpful == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "helpful is required"})
+		return
+	}
+	if input.Helpful != nil {
+		feedback.Helpful = *input.Helpful
+	}
+	if input.Reasons != nil {
+		feedback.Reasons = uniqueStrings(input.Reasons)
+	}
+	if input.Comment != nil {
+		feedback.Comment = strings.TrimSpace(*input.Comment)
+	}
+	if input.Followed != nil {
+		feedback.Followed = input.Followed
+	}
+	if err := DB.Save(&feedback).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feedback"})
+		return
+	}
+
+	status := http.StatusOK
+	if isNew {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"feedback": feedback})
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// summarizeFeedback compares the ratings given since the time by source,
+// model, endpoint and prompt version, most rated groups first
+func summarizeFeedback(since time.Time) ([]FeedbackSummary, error) {
+	var rows []struct {
+		RecommendationFeedback
+		Source        string
+		Model         string
+		Endpoint      string
+		PromptVersion string
+	}
+	err := DB.Model(&RecommendationFeedback{}).
+		Select("recommendation_feedbacks.*, recommendations.source, recommendations.model, recommendations.endpoint, recommendations.prompt_version").
+		Joins("JOIN recommendations ON recommendations.id = recommendation_feedbacks.recommendation_id").
+		Where("recommendation_feedbacks.updated_at >= ?", since).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[[4]string]*FeedbackSummary{}
+	summaries := []*FeedbackSummary{}
+	for _, row := range rows {
+		key := [4]string{row.Source, row.Model, row.Endpoint, row.PromptVersion}
+		summary, ok := groups[key]
+		if !ok {
+			summary = &FeedbackSummary{Source: row.Source, Model: row.Model, Endpoint: row.Endpoint,
+				PromptVersion: row.PromptVersion, Reasons: map[string]int{}}
+			groups[key] = summary
+			summaries = append(summaries, summary)
+		}
+		summary.Ratings++
+		if row.Helpful {
+			summary.Helpful++
+		}
+		if row.Followed != nil {
+			summary.FollowedKnown++
+			if *row.Followed {
+				summary.Followed++
+			}
+		}
+		for _, reason := range row.Reasons {
+			summary.Reasons[reason]++
+		}
+	}
+
+	result := make([]FeedbackSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		summary.HelpfulRate = math.Round(1000*float64(summary.Helpful)/float64(summary.Ratings)) / 1000
+		result = append(result, *summary)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Ratings > result[j].Ratings })
+	return result, nil
+}
+
+// ExportFeedback writes every rated recommendation as a JSON line with its
+// prompt template, input, output and rating, for evaluating prompts and
+// models. The rendered prompts, patient context, user IDs and the notes on
+// readings are left out, but the meal descriptions, the rule-based
+// assessment, the output and the user's comment can still identify someone,
+// so the file must be handled as health data. It returns the number of
+// examples written.
+func ExportFeedback(path string) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	var feedback []RecommendationFeedback
+	count := 0
+	err = DB.Order("id").FindInBatches(&feedback, 500, func(tx *gorm.DB, batch int) error {
+		ids := make([]uint, 0, len(feedback))
+		for _, f := range feedback {
+			ids = append(ids, f.RecommendationID)
+		}
+		var recommendations []Recommendation
+		if err := DB.Where("id IN ?", ids).Find(&recommendations).Error; err != nil {
+			return err
+		}
+		byID := make(map[uint]Recommendation, len(recommendations))
+		var readingIDs, dietIDs []uint
+		for _, r := range recommendations {
+			byID[r.ID] = r
+			if r.GlucoseReadingID != nil {
+				readingIDs = append(readingIDs, *r.GlucoseReadingID)
+			}
+			if r.DietLogID != nil {
+				dietIDs = append(dietIDs, *r.DietLogID)
+			}
+		}
+		var readings []GlucoseReading
+		if err := DB.Where("id IN ?", readingIDs).Find(&readings).Error; err != nil {
+			return err
+		}
+		readingsByID := make(map[uint]GlucoseReading, len(readings))
+		for _, reading := range readings {
+			readingsByID[reading.ID] = reading
+		}
+		var diets []DietLog
+		if err := DB.Preload("Items").Where("id IN ?", dietIDs).Find(&diets).Error; err != nil {
+			return err
+		}
+		dietsByID := make(map[uint]DietLog, len(diets))
+		for _, diet := range diets {
+			dietsByID[diet.ID] = diet
+		}
+
+		for _, f := range feedback {
+			r, ok := byID[f.RecommendationID]
+			if !ok {
+				continue
+			}
+			example := FeedbackExample{
+				RecommendationID: r.ID,
+				Endpoint:         r.Endpoint,
+				Source:           r.Source,
+				Provider:         r.Provider,
+				Model:            r.Model,
+				PromptTemplate:   r.PromptTemplate,
+				PromptVersion:    r.PromptVersion,
+				RuleAssessment:   r.RuleRecommendation,
+				Input:            feedbackInput(r, readingsByID, dietsByID),
+				Output:           r.Output,
+				Structured:       r.Structured,
+				Helpful:          f.Helpful,
+				Reasons:          f.Reasons,
+				Comment:          f.Comment,
+				Followed:         f.Followed,
+				RecommendedAt:    r.CreatedAt,
+				RatedAt:          f.UpdatedAt,
+			}
+			if err := encoder.Encode(example); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return count, fmt.Errorf("failed to export feedback: %w", err)
+	}
+	return count, writer.Flush()
+}
+
+// feedbackInput collects the de-identified input of a recommendation.
+// Readings and meals deleted since are left empty, keeping their IDs.
+func feedbackInput(r Recommendation, readings map[uint]GlucoseReading, diets map[uint]DietLog) FeedbackInput {
+	input := FeedbackInput{GlucoseReadingID: r.GlucoseReadingID, DietLogID: r.DietLogID}
+	if r.GlucoseReadingID != nil {
+		if reading, ok := readings[*r.GlucoseReadingID]; ok {
+			hour := reading.RecordedAt.UTC().Hour()
+			input.GlucoseLevel, input.GlucoseMealTag, input.Hour = &reading.Level, reading.MealTag, &hour
+		}
+	}
+	if r.DietLogID != nil {
+		if diet, ok := diets[*r.DietLogID]; ok {
+			input.Food, input.MealType = diet.FoodDescription, diet.MealType
+			input.Calories, input.Carbs = &diet.Calories, &diet.Carbs
+			if glycemicLoadKnown(diet) {
+				input.GlycemicLoad = &diet.GlycemicLoad
+			}
+		}
+	}
+	return input
+}
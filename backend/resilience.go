@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Defaults used when the corresponding environment variables are not set
+const (
+	defaultAIRequestTimeout  = 2 * time.Minute  // AI_REQUEST_TIMEOUT, all calls of one request
+	defaultRetryAttempts     = 3                // AI_RETRY_ATTEMPTS, calls per operation
+	defaultBreakerFailures   = 5                // CIRCUIT_BREAKER_FAILURES, consecutive failures that open a breaker
+	defaultBreakerCooldown   = 30 * time.Second // CIRCUIT_BREAKER_COOLDOWN, how long a breaker stays open
+	retryBaseDelay           = 500 * time.Millisecond
+	retryMaxDelay            = 5 * time.Second
+	defaultClassifierTimeout = 30 * time.Second // FOOD_CLASSIFIER_TIMEOUT, one classifier call
+)
+
+// errCircuitOpen is returned without calling the upstream while its breaker
+// is open
+var errCircuitOpen = errors.New("upstream temporarily unavailable")
+
+// One breaker per upstream
+var (
+	llmBreaker        = &circuitBreaker{name: "llm"}
+	classifierBreaker = &circuitBreaker{name: "food_classifier"}
+)
+
+// circuitBreaker stops calls to an upstream after consecutive transient
+// failures. Once the cooldown has passed one probe call is let through: it
+// closes the breaker when it succeeds and opens it again when it fails.
+type circuitBreaker struct {
+	name          string
+	mu            sync.Mutex
+	failures      int
+	openedAt      time.Time // zero while closed
+	probing       bool
+	lastFailureAt time.Time
+}
+
+// BreakerStatus is the state of a breaker reported by GET /status. The
+// endpoint is public, so error messages, which can hold upstream response
+// bodies, are only logged.
+type BreakerStatus struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"` // closed, open or half_open
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+// envInt reads a positive integer setting
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// envDuration reads a positive duration setting such as 30s
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// allow returns errCircuitOpen when the call must not be made
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < envDuration("CIRCUIT_BREAKER_COOLDOWN", defaultBreakerCooldown) {
+		return fmt.Errorf("%s: %w", b.name, errCircuitOpen)
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the outcome of a call. Only a success closes the breaker and
+// only transient failures count against it. Other errors, such as a call
+// cancelled by the client or a rejected request, leave it as it is, ending a
+// probe so the next call can probe again.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch {
+	case err == nil:
+		b.failures = 0
+		if !b.openedAt.IsZero() {
+			fmt.Printf("Circuit breaker %s closed\n", b.name)
+		}
+		b.openedAt = time.Time{}
+		return
+	case !isTransient(err):
+		return
+	}
+
+	b.failures++
+	b.lastFailureAt = time.Now()
+	if !b.openedAt.IsZero() || b.failures >= envInt("CIRCUIT_BREAKER_FAILURES", defaultBreakerFailures) {
+		if b.openedAt.IsZero() {
+			fmt.Printf("Circuit breaker %s opened after %d failures: %v\n", b.name, b.failures, err)
+		} else {
+			fmt.Printf("Circuit breaker %s stays open, probe failed: %v\n", b.name, err)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// open reports whether the breaker is refusing calls or waiting for a probe
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{Name: b.name, State: "closed", ConsecutiveFailures: b.failures}
+	if !b.lastFailureAt.IsZero() {
+		lastFailureAt := b.lastFailureAt
+		status.LastFailureAt = &lastFailureAt
+	}
+	if !b.openedAt.IsZero() {
+		openUntil := b.openedAt.Add(envDuration("CIRCUIT_BREAKER_COOLDOWN", defaultBreakerCooldown))
+		status.State = "open"
+		if b.probing || time.Now().After(openUntil) {
+			status.State = "half_open"
+		}
+		status.OpenUntil = &openUntil
+	}
+	return status
+}
+
+// upstreamStatusError is an unexpected HTTP status from an upstream
+type upstreamStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+// permanentError marks a failure that must not be retried, e.g. a stream
+// that already sent text
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// isTransient reports whether a failed call may succeed when repeated:
+// timeouts, network errors, rate limiting and server errors
+func isTransient(err error) bool {
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	var statusErr *upstreamStatusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, errCircuitOpen):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &apiErr):
+		return transientStatus(apiErr.HTTPStatusCode)
+	case errors.As(err, &requestErr):
+		return transientStatus(requestErr.HTTPStatusCode)
+	case errors.As(err, &statusErr):
+		return transientStatus(statusErr.StatusCode)
+	case errors.As(err, &netErr):
+		return true
+	}
+	return false
+}
+
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// callWithRetry makes a call through the breaker, repeating transient
+// failures with exponential backoff and full jitter until AI_RETRY_ATTEMPTS
+// calls were made or ctx is done
+func callWithRetry(ctx context.Context, breaker *circuitBreaker, call func(context.Context) error) error {
+	attempts := envInt("AI_RETRY_ATTEMPTS", defaultRetryAttempts)
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := retryBaseDelay << (attempt - 1)
+			if delay > retryMaxDelay {
+				delay = retryMaxDelay
+			}
+			delay = time.Duration(rand.Int63n(int64(delay) + 1))
+			fmt.Printf("Retrying %s in %v after: %v\n", breaker.name, delay.Round(time.Millisecond), err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+
+		if err = breaker.allow(); err != nil {
+			return err
+		}
+		err = call(ctx)
+		breaker.record(err)
+
+		var permanent permanentError
+		if err == nil || !isTransient(err) || errors.As(err, &permanent) || ctx.Err() != nil || breaker.open() {
+			return err
+		}
+	}
+	return err
+}
+
+// aiRequestContext bounds all AI calls made for one request with
+// AI_REQUEST_TIMEOUT, and ends them when the client goes away
+func aiRequestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), envDuration("AI_REQUEST_TIMEOUT", defaultAIRequestTimeout))
+}
+
+// aiErrorStatus is the HTTP status reported for a failed AI call
+func aiErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// resilientLLMProvider adds retries and the LLM circuit breaker to a provider
+type resilientLLMProvider struct {
+	provider LLMProvider
+	breaker  *circuitBreaker
+}
+
+func (p *resilientLLMProvider) Name() string {
+	return p.provider.Name()
+}
+
+func (p *resilientLLMProvider) Complete(ctx context.Context, req LLMRequest) (LLMResponse, error) {
+	var resp LLMResponse
+	err := callWithRetry(ctx, p.breaker, func(ctx context.Context) error {
+		var err error
+		resp, err = p.provider.Complete(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// Stream is only retried while no text was passed to onDelta
+func (p *resilientLLMProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (LLMResponse, error) {
+	var resp LLMResponse
+	err := callWithRetry(ctx, p.breaker, func(ctx context.Context) error {
+		started := false
+		var err error
+		resp, err = p.provider.Stream(ctx, req, func(delta string) error {
+			started = true
+			return onDelta(delta)
+		})
+		if err != nil && started {
+			return permanentError{err}
+		}
+		return err
+	})
+	return resp, err
+}
+
+// GET /status reports the circuit breakers of the AI upstreams
+func GetStatus(c *gin.Context) {
+	breakers := []BreakerStatus{llmBreaker.status(), classifierBreaker.status()}
+	healthy := true
+	for _, breaker := range breakers {
+		if breaker.State != "closed" {
+			healthy = false
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":   map[bool]string{true: "ok", false: "degraded"}[healthy],
+		"breakers": breakers,
+	})
+}
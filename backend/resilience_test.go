@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = &upstreamStatusError{StatusCode: http.StatusServiceUnavailable, Body: "unavailable"}
+	errRejected  = &upstreamStatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_FAILURES", "2")
+	t.Setenv("CIRCUIT_BREAKER_COOLDOWN", "20ms")
+	b := &circuitBreaker{name: "test"}
+	cooldown := func() { time.Sleep(30 * time.Millisecond) }
+	expectState := func(step, want string) {
+		t.Helper()
+		if got := b.status().State; got != want {
+			t.Fatalf("%s: state = %s, want %s", step, got, want)
+		}
+	}
+
+	b.record(errTransient)
+	expectState("one failure", "closed")
+	b.record(errRejected)
+	expectState("rejected request", "closed")
+	if b.failures != 1 {
+		t.Fatalf("rejected request: failures = %d, want 1", b.failures)
+	}
+	b.record(errTransient)
+	expectState("two failures", "open")
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("open: allow() = %v, want errCircuitOpen", err)
+	}
+
+	// One probe at a time once the cooldown has passed
+	cooldown()
+	if err := b.allow(); err != nil {
+		t.Fatalf("after cooldown: allow() = %v, want a probe", err)
+	}
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("while probing: allow() = %v, want errCircuitOpen", err)
+	}
+
+	// A cancelled or rejected probe ends the probe without closing the breaker
+	for _, err := range []error{context.Canceled, errRejected} {
+		b.record(err)
+		expectState("probe failed with "+err.Error(), "half_open")
+		if err := b.allow(); err != nil {
+			t.Fatalf("after an ended probe: allow() = %v, want a new probe", err)
+		}
+	}
+
+	// A failed probe opens it for another cooldown
+	b.record(errTransient)
+	expectState("failed probe", "open")
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("after a failed probe: allow() = %v, want errCircuitOpen", err)
+	}
+
+	// A successful probe closes it
+	cooldown()
+	if err := b.allow(); err != nil {
+		t.Fatalf("after cooldown: allow() = %v, want a probe", err)
+	}
+	b.record(nil)
+	expectState("successful probe", "closed")
+	if b.failures != 0 {
+		t.Fatalf("successful probe: failures = %d, want 0", b.failures)
+	}
+}
+
+func TestCallWithRetry(t *testing.T) {
+	t.Setenv("AI_RETRY_ATTEMPTS", "3")
+	t.Setenv("CIRCUIT_BREAKER_FAILURES", "5")
+	tests := []struct {
+		name      string
+		results   []error // returned by the calls in order, then nil
+		failures  int     // consecutive failures before the call
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 0, 1, nil},
+		{"transient failures are retried", []error{errTransient, errTransient}, 0, 3, nil},
+		{"gives up after the attempts", []error{errTransient, errTransient, errTransient}, 0, 3, errTransient},
+		{"rejected request is not retried", []error{errRejected}, 0, 1, errRejected},
+		{"permanent error is not retried", []error{permanentError{errTransient}}, 0, 1, errTransient},
+		{"cancelled call is not retried", []error{context.Canceled}, 0, 1, context.Canceled},
+		{"stops when the breaker opens", []error{errTransient, errTransient, errTransient}, 3, 2, errTransient},
+		{"open breaker makes no call", nil, 5, 0, errCircuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{name: "test", failures: tt.failures}
+			if tt.failures >= 5 {
+				b.openedAt = time.Now()
+			}
+			calls := 0
+			err := callWithRetry(context.Background(), b, func(context.Context) error {
+				calls++
+				if calls <= len(tt.results) {
+					return tt.results[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCallWithRetryStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := callWithRetry(ctx, &circuitBreaker{name: "test"}, func(context.Context) error {
+		calls++
+		cancel()
+		return errTransient
+	})
+	if calls != 1 || !errors.Is(err, errTransient) {
+		t.Errorf("calls = %d, err = %v, want one call failing with %v", calls, err, errTransient)
+	}
+}
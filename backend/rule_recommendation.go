@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a recommendation came from
+const (
+	recommendationSourceAI    = "ai"
+	recommendationSourceRules = "rules"
+)
+
+// Glucose states the rule-based suggestions are keyed on
+const (
+	glucoseStateLow     = "low"
+	glucoseStateInRange = "in_range"
+	glucoseStateHigh    = "high"
+)
+
+// ruleMealSlot is a meal of the day and the hour it ends
+type ruleMealSlot struct {
+	name  string
+	until int
+}
+
+var ruleMealSlots = []ruleMealSlot{
+	{"breakfast", 10},
+	{"lunch", 15},
+	{"dinner", 20},
+	{"evening snack", 24},
+}
+
+// Curated meals per slot. Balanced meals are suggested while glucose is in
+// range, lower-carb ones when it is high or little of the day's carbohydrate
+// target is left.
+var (
+	balancedRuleMeals = map[string]SuggestedMeal{
+		"breakfast":     {Name: "Porridge oats with berries and a spoon of seeds", Carbs: 40, Reasoning: "Whole oats and fiber release their carbohydrate slowly."},
+		"lunch":         {Name: "Wholegrain wrap with turkey or hummus and salad", Carbs: 45, Reasoning: "Wholegrains with protein and vegetables keep the rise after lunch gentle."},
+		"dinner":        {Name: "Lentil and vegetable curry with a small portion of brown rice", Carbs: 50, Reasoning: "Lentils combine protein and slow carbohydrate for a steady evening."},
+		"evening snack": {Name: "An apple with a spoon of peanut butter", Carbs: 20, Reasoning: "A small snack with protein and fat helps to avoid a low overnight."},
+	}
+	lowerCarbRuleMeals = map[string]SuggestedMeal{
+		"breakfast":     {Name: "Vegetable omelette with a slice of wholegrain toast", Carbs: 15, Reasoning: "Eggs and vegetables fill you up with little carbohydrate."},
+		"lunch":         {Name: "Grilled chicken or tofu salad with chickpeas", Carbs: 25, Reasoning: "Protein and non-starchy vegetables keep the meal light on carbohydrate."},
+		"dinner":        {Name: "Baked salmon with roasted non-starchy vegetables", Carbs: 15, Reasoning: "Fish and vegetables add very little carbohydrate to the day."},
+		"evening snack": {Name: "Plain Greek yoghurt with a few nuts", Carbs: 8, Reasoning: "A protein snack if you are hungry, without raising your glucose much."},
+	}
+	fastActingRuleMeal = SuggestedMeal{Name: "Now: glucose tablets or half a glass of fruit juice", Carbs: 15,
+		Reasoning: "Fast-acting carbohydrate raises a low within about 15 minutes."}
+)
+
+// aiRecommendationsEnabled reports whether recommendations are generated by
+// the LLM; AI_RECOMMENDATIONS_ENABLED=false uses only the rule-based
+// recommendation
+func aiRecommendationsEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("AI_RECOMMENDATIONS_ENABLED"))
+	return err != nil || enabled
+}
+
+func glucoseState(level float64) string {
+	switch {
+	case level < targetRangeLow:
+		return glucoseStateLow
+	case level > targetRangeHigh:
+		return glucoseStateHigh
+	}
+	return glucoseStateInRange
+}
+
+// ruleBasedRecommendation builds a recommendation without the LLM from the
+// rule-based assessment, suggesting curated meals and activities for the
+// state of the latest reading, the carbohydrate eaten today and the time of
+// day. The first diet log is the meal just submitted, which is taken to be the
+// meal of the current slot.
+func ruleBasedRecommendation(assessment string, profile MedicalProfile, diets []DietLog, glucose []GlucoseReading, now time.Time) StructuredRecommendation {
+	var level float64
+	if len(glucose) > 0 {
+		level = glucose[0].Level
+	}
+	state := glucoseState(level)
+	recommendation := StructuredRecommendation{
+		Assessment: assessment,
+		Severity:   "normal",
+		Meals:      []SuggestedMeal{},
+		Activities: []SuggestedActivity{},
+		FollowUp:   []string{},
+	}
+	switch {
+	case level < severeLowGlucose || level > severeHighGlucose:
+		recommendation.Severity = "urgent"
+	case state != glucoseStateInRange:
+		recommendation.Severity = "attention"
+	}
+
+	// The meals still to come today, or the evening snack late in the day
+	var slots []string
+	for _, slot := range ruleMealSlots {
+		if now.Hour() < slot.until {
+			slots = append(slots, slot.name)
+		}
+	}
+	if len(slots) > 1 {
+		slots = slots[1:]
+	}
+	if len(slots) > 3 {
+		slots = slots[:3]
+	}
+
+	carbTarget := profile.DailyCarbTarget
+	if carbTarget == 0 {
+		carbTarget = defaultDailyCarbs
+	}
+	remaining := carbTarget
+	for _, diet := range diets {
+		remaining -= diet.Carbs
+	}
+	perMeal := remaining / float64(len(slots))
+
+	if state == glucoseStateLow {
+		recommendation.Meals = append(recommendation.Meals, fastActingRuleMeal)
+	}
+	budgetNoted := false
+	for _, slot := range slots {
+		meal := balancedRuleMeals[slot]
+		if state == glucoseStateHigh || (state == glucoseStateInRange && perMeal < meal.Carbs) {
+			meal = lowerCarbRuleMeals[slot]
+		}
+		meal.Name = fmt.Sprintf("%s: %s", strings.ToUpper(slot[:1])+slot[1:], meal.Name)
+		if state != glucoseStateLow && perMeal < meal.Carbs && !budgetNoted {
+			budgetNoted = true
+			meal.Reasoning += fmt.Sprintf(" About %.0f g of your %.0f g daily carbohydrate target is left.", max(remaining, 0), carbTarget)
+		}
+		recommendation.Meals = append(recommendation.Meals, meal)
+	}
+
+	timing := "after your next meal"
+	if len(slots) == 1 && slots[0] == "evening snack" {
+		timing = "tomorrow after breakfast"
+	}
+	switch {
+	case state == glucoseStateLow:
+		recommendation.FollowUp = append(recommendation.FollowUp,
+			"Check your glucose again in 15 minutes and repeat the fast-acting carbohydrate if it is still below 70 mg/dL.",
+			"Avoid exercise until your glucose is back above 100 mg/dL.")
+		if level < severeLowGlucose {
+			recommendation.FollowUp = append(recommendation.FollowUp,
+				"If it does not rise or you feel confused, call emergency services (911).")
+		}
+	case level > severeHighGlucose:
+		recommendation.FollowUp = append(recommendation.FollowUp,
+			"Check your glucose again in 1 to 2 hours and check for ketones if you can.",
+			"Avoid hard exercise until your glucose is lower.",
+			"Call your doctor today if it stays this high, and seek emergency care if you feel unwell.")
+	case state == glucoseStateHigh:
+		recommendation.Activities = append(recommendation.Activities,
+			SuggestedActivity{Type: "Brisk walk", DurationMinutes: 20, Timing: timing})
+		recommendation.FollowUp = append(recommendation.FollowUp,
+			"Check your glucose again in 2 hours.",
+			"Stay hydrated with plenty of water.")
+	default:
+		recommendation.Activities = append(recommendation.Activities,
+			SuggestedActivity{Type: "Walk", DurationMinutes: 15, Timing: timing})
+		recommendation.FollowUp = append(recommendation.FollowUp,
+			"Check your glucose 2 hours after your next meal.")
+	}
+	return recommendation
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Readings beyond these limits (mg/dL) need urgent care rather than diet advice
+const (
+	severeLowGlucose  = 54
+	severeHighGlucose = 300
+)
+
+const (
+	medicalDisclaimer = "This advice is general information and not a substitute for your doctor or diabetes care team. " +
+		"Never change your insulin or medication without talking to them."
+	dosingNotice = "Advice about insulin or medication doses was removed. " +
+		"Please ask your doctor or diabetes care team before changing any dose."
+	severeLowGuidance = "URGENT: Your glucose is dangerously low. Take 15-20 g of fast-acting carbohydrate (glucose tablets, juice or regular soda) now " +
+		"and recheck in 15 minutes. If you feel confused, cannot swallow safely or it does not rise, call emergency services (911)."
+	severeHighGuidance = "URGENT: Your glucose is very high. Drink water, check for ketones if you can and contact your doctor today. " +
+		"If you are vomiting, breathing fast, confused or very drowsy, seek emergency care (911) immediately."
+)
+
+var (
+	// A dose amount ("4 units", "two units", "6 more units", "500 mg") in a
+	// sentence naming insulin or a diabetes drug
+	doseAmountPattern = regexp.MustCompile(`(?i)\b(\d+(\.\d+)?|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|fifteen|twenty|half an?|a half)\s*((extra|more|additional|fewer|less|further)\s+)?(units?|u|iu|mg|mcg|ml|tablets?|pills?)\b`)
+	// An amount of units, which is an insulin dose whether or not insulin is
+	// named ("Inject 6 more units.")
+	insulinUnitsPattern = regexp.MustCompile(`(?i)\b(\d+(\.\d+)?|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|fifteen|twenty|half an?|a half)\s*((extra|more|additional|fewer|less|further)\s+)?(units?|iu)\b`)
+	medicationPattern   = regexp.MustCompile(`(?i)\b(insulin|bolus|basal|dose|dosage|medication|medicine|metformin|glipizide|glyburide|glimepiride|gliclazide|sulfonylurea|pioglitazone|sitagliptin|januvia|empagliflozin|jardiance|dapagliflozin|semaglutide|ozempic|liraglutide|glargine|lantus|lispro|humalog|aspart|novolog|novorapid|fiasp|levemir|detemir|degludec|tresiba)`)
+	// Treatment for a low ("4 glucose tablets", "120 ml of juice"), which is
+	// not a drug dose and is ignored by the dosing rule
+	lowTreatmentPattern = regexp.MustCompile(`(?i)\b(glucose|dextrose)\s+(tablets?|gels?)\b|\b(tablets?|gels?)\s+of\s+(glucose|dextrose)\b|\b\d+\s*(ml|g)\s+(of\s+)?(fruit\s+)?(juice|water|milk|soda|regular soda|sugar)\b`)
+	// Advice to keep taking a drug as it is, not a dose to take. It only
+	// excuses an amount in the same clause when no verb tells the user to
+	// take it ("Your metformin 500 mg should be continued.").
+	continueDosePattern = regexp.MustCompile(`(?i)\b(continue[ds]?|keep (taking|using)|as prescribed)\b`)
+	dosingVerbPattern   = regexp.MustCompile(`(?i)\b(take|inject|use|give|add|administer)\b`)
+	// Where a sentence splits into clauses that are checked separately
+	clauseSeparatorPattern = regexp.MustCompile(`(?i)[,;:]|\b(and|but|then|or)\b`)
+	// Instructions to change a dose without numbers
+	doseChangePattern = regexp.MustCompile(`(?i)\b(increase|decrease|reduce|raise|lower|double|halve|skip|stop|adjust|take (more|less|extra))\b[^.!?\n]{0,30}\b(insulin|dose|dosage|medication|medicine|metformin|bolus|basal)`)
+	// Advice to cut carbohydrates, wrong during a low
+	restrictCarbsPattern = regexp.MustCompile(`(?i)\b(reduce|limit|cut|avoid|restrict|lower|minimi[sz]e|skip|cut back on)\b[^.!?\n]{0,30}\b(carbs?|carbohydrates?|sugars?|sweets)`)
+	// Advice to eat sugar, wrong during a high
+	eatSugarPattern = regexp.MustCompile(`(?i)\b(eat|have|drink|take|consume)\b[^.!?\n]{0,30}\b(fast[- ]acting carb\w*|glucose tablets?|sugary|candy|sweets|juice|regular soda)`)
+	// Wording that counts as urgent-care guidance
+	urgentCarePattern = regexp.MustCompile(`(?i)\b(emergency|urgent|911|immediately|right away|call your doctor|seek medical)`)
+	// A sentence including its closing punctuation, or the rest of a line.
+	// A period followed by a digit ("2.5") doesn't end a sentence.
+	sentencePattern = regexp.MustCompile(`(?:[^.!?\n]|\.\d)*[.!?]+["')\]]*|(?:[^.!?\n]|\.\d)+`)
+)
+
+// GuardrailViolation records output that the safety layer changed, for review
+type GuardrailViolation struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	RecommendationID uint      `gorm:"index" json:"recommendation_id"`
+	ChatMessageID    uint      `gorm:"index" json:"chat_message_id"`
+	MealPlanID       uint      `gorm:"index" json:"meal_plan_id"`
+	UserID           uint      `gorm:"not null;index" json:"user_id"`
+	Rule             string    `gorm:"not null" json:"rule"` // dosing_instruction, contradicts_assessment, missing_urgent_guidance or understated_severity
+	Excerpt          string    `json:"excerpt"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// guardrail checks the output for one recommendation. Sentences are checked
+// one at a time so streamed output can be filtered before it is sent.
+type guardrail struct {
+	low, high       bool // the triggering reading
+	severeLow       bool
+	severeHigh      bool
+	removedDosing   bool
+	sawUrgentAdvice bool
+	violations      []GuardrailViolation
+}
+
+func newGuardrail(glucose []GlucoseReading) *guardrail {
+	g := &guardrail{}
+	if len(glucose) > 0 {
+		level := glucose[0].Level
+		g.low = level < targetRangeLow
+		g.high = level > targetRangeHigh
+		g.severeLow = level < severeLowGlucose
+		g.severeHigh = level > severeHighGlucose
+	}
+	return g
+}
+
+// prefix is sent before the model's text: urgent guidance for severe readings
+func (g *guardrail) prefix() string {
+	switch {
+	case g.severeLow:
+		return severeLowGuidance + "\n\n"
+	case g.severeHigh:
+		return severeHighGuidance + "\n\n"
+	}
+	return ""
+}
+
+// checkSentence returns the sentence, or "" when it must not reach the user
+func (g *guardrail) checkSentence(sentence string) string {
+	if urgentCarePattern.MatchString(sentence) {
+		g.sawUrgentAdvice = true
+	}
+
+	excerpt := strings.TrimSpace(sentence)
+	if isDosingInstruction(sentence) {
+		g.violations = append(g.violations, GuardrailViolation{Rule: "dosing_instruction", Excerpt: excerpt})
+		g.removedDosing = true
+		return ""
+	}
+	if g.low && restrictCarbsPattern.MatchString(sentence) {
+		g.violations = append(g.violations, GuardrailViolation{Rule: "contradicts_assessment", Excerpt: excerpt})
+		return ""
+	}
+	if g.high && eatSugarPattern.MatchString(sentence) {
+		g.violations = append(g.violations, GuardrailViolation{Rule: "contradicts_assessment", Excerpt: excerpt})
+		return ""
+	}
+	return sentence
+}
+
+// isDosingInstruction reports whether a sentence tells the user to change a
+// dose or to take an amount of insulin or a diabetes drug. Treatment for a
+// low is allowed, and so is an amount in a clause that only says to continue
+// a drug as it is.
+func isDosingInstruction(sentence string) bool {
+	if doseChangePattern.MatchString(sentence) {
+		return true
+	}
+	drugText := lowTreatmentPattern.ReplaceAllString(sentence, "")
+	namesDrug := medicationPattern.MatchString(drugText)
+	for _, clause := range clauseSeparatorPattern.Split(drugText, -1) {
+		if insulinUnitsPattern.MatchString(clause) {
+			return true
+		}
+		if !namesDrug || !doseAmountPattern.MatchString(clause) {
+			continue
+		}
+		if !continueDosePattern.MatchString(clause) || dosingVerbPattern.MatchString(clause) {
+			return true
+		}
+	}
+	return false
+}
+
+// notices follow the model's text: the notice about removed dosing advice and
+// the disclaimer. It also records missing urgent guidance.
+func (g *guardrail) notices() []string {
+	if (g.severeLow || g.severeHigh) && !g.sawUrgentAdvice {
+		g.violations = append(g.violations, GuardrailViolation{Rule: "missing_urgent_guidance"})
+	}
+
+	var notices []string
+	if g.removedDosing {
+		notices = append(notices, dosingNotice)
+	}
+	return append(notices, medicalDisclaimer)
+}
+
+// suffix is sent after the model's text
+func (g *guardrail) suffix() string {
+	return "\n\n" + strings.Join(g.notices(), "\n\n")
+}
+
+// filter checks every sentence of text, keeping line breaks. Lines left
+// without text, e.g. a bullet that only held dosing advice, are dropped.
+func (g *guardrail) filter(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	for i, line := range lines {
+		var sb strings.Builder
+		for _, sentence := range sentencePattern.FindAllString(line, -1) {
+			sb.WriteString(g.checkSentence(sentence))
+		}
+		filtered := sb.String()
+		if strings.TrimSpace(line) != "" && strings.Trim(filtered, " -*\t") == "" && i < len(lines)-1 {
+			continue
+		}
+		kept = append(kept, filtered)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// apply returns the safe version of a complete output
+func (g *guardrail) apply(output string) string {
+	return g.prefix() + strings.TrimSpace(g.filter(output)) + g.suffix()
+}
+
+// applyStructured returns the safe version of a structured recommendation.
+// Every text field is filtered and suggestions left without a name are
+// dropped. Severe readings are always reported as urgent.
+func (g *guardrail) applyStructured(structured StructuredRecommendation) StructuredRecommendation {
+	clean := func(text string) string {
+		return strings.TrimSpace(g.filter(text))
+	}
+
+	safe := StructuredRecommendation{
+		Guidance:   strings.TrimSpace(g.prefix()),
+		Assessment: clean(structured.Assessment),
+		Severity:   structured.Severity,
+		Meals:      []SuggestedMeal{},
+		Activities: []SuggestedActivity{},
+		FollowUp:   []string{},
+	}
+	if (g.severeLow || g.severeHigh) && safe.Severity != "urgent" {
+		g.violations = append(g.violations, GuardrailViolation{Rule: "understated_severity", Excerpt: structured.Severity})
+		safe.Severity = "urgent"
+	}
+	for _, meal := range structured.Meals {
+		meal.Name, meal.Reasoning = clean(meal.Name), clean(meal.Reasoning)
+		if meal.Name != "" {
+			safe.Meals = append(safe.Meals, meal)
+		}
+	}
+	for _, activity := range structured.Activities {
+		activity.Type, activity.Timing = clean(activity.Type), clean(activity.Timing)
+		if activity.Type != "" {
+			safe.Activities = append(safe.Activities, activity)
+		}
+	}
+	for _, check := range structured.FollowUp {
+		if check = clean(check); check != "" {
+			safe.FollowUp = append(safe.FollowUp, check)
+		}
+	}
+	safe.Notices = g.notices()
+	return safe
+}
+
+// sentenceBuffer collects streamed text and releases it a sentence at a time
+type sentenceBuffer struct {
+	pending strings.Builder
+}
+
+// add appends a delta and returns the complete sentences now available
+func (b *sentenceBuffer) add(delta string) string {
+	b.pending.WriteString(delta)
+	text := b.pending.String()
+	cut := strings.LastIndexAny(text, ".!?\n")
+	// "2.5" is not the end of a sentence
+	for cut >= 0 && cut < len(text)-1 && text[cut] == '.' && text[cut+1] >= '0' && text[cut+1] <= '9' {
+		cut = strings.LastIndexAny(text[:cut], ".!?\n")
+	}
+	// Wait for what follows the punctuation to know whether it ends a sentence
+	if cut < 0 || cut == len(text)-1 {
+		return ""
+	}
+	b.pending.Reset()
+	b.pending.WriteString(text[cut+1:])
+	return text[:cut+1]
+}
+
+// flush returns whatever is left
+func (b *sentenceBuffer) flush() string {
+	text := b.pending.String()
+	b.pending.Reset()
+	return text
+}
+
+// saveGuardrailViolations logs the violations of a stored recommendation
+func saveGuardrailViolations(record Recommendation, violations []GuardrailViolation) {
+	for i := range violations {
+		violations[i].RecommendationID = record.ID
+		violations[i].UserID = record.UserID
+		fmt.Printf("Guardrail violation on recommendation %d: %s %q\n", record.ID, violations[i].Rule, violations[i].Excerpt)
+	}
+	if len(violations) > 0 {
+		if err := DB.Create(&violations).Error; err != nil {
+			fmt.Println("Error saving guardrail violations:", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestGuardrailDosingRule(t *testing.T) {
+	tests := []struct {
+		level    float64
+		sentence string
+		removed  bool
+	}{
+		// Treatment for a low is not a drug dose
+		{60, "Drink 120 ml of juice or take 4 glucose tablets now.", false},
+		{60, "Take two tablets of glucose and recheck in 15 minutes.", false},
+		{60, "Have 15 g of glucose gel if you cannot eat.", false},
+		{60, "Sip 150 ml of regular soda.", false},
+		// Continuing a drug as prescribed is not an instruction to dose
+		{120, "Your metformin 500 mg should be continued.", false},
+		{120, "Keep taking your insulin as prescribed.", false},
+		// Doses of insulin or diabetes drugs
+		{60, "Take two units of rapid insulin now.", true},
+		{250, "Take 4 units of insulin before dinner.", true},
+		{250, "Inject ten units of Humalog.", true},
+		{120, "Take 500 mg metformin with dinner.", true},
+		{120, "Take half a tablet of glipizide tonight.", true},
+		{250, "Increase your basal insulin tonight.", true},
+		{60, "Skip your next metformin dose.", true},
+		{250, "Take 4 extra units of insulin.", true},
+		{250, "Inject 6 more units.", true},
+		{250, "Use 2 units of Novorapid now.", true},
+		{250, "Keep taking your insulin as prescribed and add 4 units at dinner.", true},
+		{250, "Take 10 units of insulin as prescribed by your sliding scale.", true},
+		{250, "Continue metformin but take 1000 mg tonight.", true},
+		// Nothing about doses
+		{120, "A 20 minute walk after dinner helps.", false},
+		{120, "Talk to your doctor about your medication.", false},
+	}
+	for _, tt := range tests {
+		g := newGuardrail([]GlucoseReading{{Level: tt.level}})
+		removed := g.checkSentence(tt.sentence) == ""
+		if removed != tt.removed {
+			t.Errorf("checkSentence(%q) at %.0f mg/dL removed = %v, want %v", tt.sentence, tt.level, removed, tt.removed)
+		}
+		if removed && (len(g.violations) != 1 || g.violations[0].Rule != "dosing_instruction") {
+			t.Errorf("checkSentence(%q) violations = %+v, want one dosing_instruction", tt.sentence, g.violations)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The model gets one more attempt with the list of problems when its output
+// doesn't match the schema
+const recommendationAttempts = 2
+
+// recommendationOutputFormat describes the JSON the model must produce. It is
+// given to the prompt templates as .OutputFormat.
+const recommendationOutputFormat = "Respond only with JSON of the form " +
+	`{"assessment":"...","severity":"normal|attention|urgent",` +
+	`"meals":[{"name":"...","carbs":0,"reasoning":"..."}],` +
+	`"activities":[{"type":"...","duration_minutes":0,"timing":"..."}],` +
+	`"follow_up":["..."]} ` +
+	"where assessment explains the latest reading in one to three sentences, severity is urgent for dangerous readings, " +
+	"attention when the reading is outside the target range and normal otherwise, " +
+	"meals are 1 to 4 suggestions for the rest of today with carbs in grams and a one or two sentence reasoning, " +
+	`activities are 0 to 3 suggestions with the duration in minutes and a timing such as "after dinner", ` +
+	"and follow_up lists 1 to 3 things to check later, such as when to measure glucose again."
+
+var recommendationSeverities = map[string]bool{"normal": true, "attention": true, "urgent": true}
+
+// StructuredRecommendation is the validated recommendation. Guidance and
+// Notices are added by the safety guardrails, not the model.
+type StructuredRecommendation struct {
+	Guidance   string              `json:"guidance,omitempty"` // urgent-care guidance for severe readings
+	Assessment string              `json:"assessment"`
+	Severity   string              `json:"severity"` // normal, attention or urgent
+	Meals      []SuggestedMeal     `json:"meals"`
+	Activities []SuggestedActivity `json:"activities"`
+	FollowUp   []string            `json:"follow_up"`
+	Notices    []string            `json:"notices"` // disclaimer and notice about removed advice
+}
+
+// SuggestedMeal is a meal suggested for the rest of the day
+type SuggestedMeal struct {
+	Name      string  `json:"name"`
+	Carbs     float64 `json:"carbs"` // grams
+	Reasoning string  `json:"reasoning"`
+}
+
+// SuggestedActivity is a suggested workout
+type SuggestedActivity struct {
+	Type            string `json:"type"`
+	DurationMinutes int    `json:"duration_minutes"`
+	Timing          string `json:"timing"`
+}
+
+// generate asks the model for the structured recommendation and validates it,
+// retrying with the problems it found. It fills in the usage, latency and raw
+// output of the record. When onSection is set the output is streamed and every
+// section is passed to it as soon as it is complete, together with the
+// attempt it belongs to.
+func (r *Recommendation) generate(ctx context.Context, onSection func(attempt int, key string, raw json.RawMessage)) (StructuredRecommendation, error) {
+	started := time.Now()
+	defer func() { r.LatencyMS = time.Since(started).Milliseconds() }()
+
+	messages := recommendationRequest(r.SystemPrompt, r.Prompt).Messages
+	var lastErr error
+	for attempt := 0; attempt < recommendationAttempts; attempt++ {
+		r.Attempts++
+		request := LLMRequest{Messages: messages, JSON: true}
+		var resp LLMResponse
+		var err error
+		if onSection == nil {
+			resp, err = llm.Complete(ctx, request)
+		} else {
+			sections := &sectionStream{onSection: func(key string, raw json.RawMessage) { onSection(attempt, key, raw) }}
+			resp, err = llm.Stream(ctx, request, func(delta string) error {
+				sections.write(delta)
+				return ctx.Err()
+			})
+		}
+		if err != nil {
+			r.Error = err.Error()
+			return StructuredRecommendation{}, err
+		}
+		if resp.Model != "" {
+			r.Model = resp.Model
+		}
+		r.PromptTokens += resp.PromptTokens
+		r.CompletionTokens += resp.CompletionTokens
+		r.RawOutput = resp.Content
+
+		structured, problems := parseStructuredRecommendation(resp.Content)
+		if len(problems) == 0 {
+			return structured, nil
+		}
+
+		lastErr = fmt.Errorf("invalid recommendation: %s", strings.Join(problems, "; "))
+		messages = append(messages,
+			LLMMessage{Role: "assistant", Content: resp.Content},
+			LLMMessage{Role: "user", Content: "Please fix these problems and return the full corrected JSON object: " + strings.Join(problems, "; ")},
+		)
+	}
+	r.Error = lastErr.Error()
+	return StructuredRecommendation{}, lastErr
+}
+
+// sectionStream reads the model's JSON object as it streams. Every top-level
+// field is passed to onSection once its value is complete, except arrays,
+// whose elements are passed one at a time under the array's key. Text before
+// the object, such as a Markdown code fence, is skipped.
+type sectionStream struct {
+	onSection  func(key string, raw json.RawMessage)
+	buf        []byte
+	pos        int
+	depth      int
+	inString   bool
+	escaped    bool
+	stringFrom int
+	key        string
+	inValue    bool // after the key's colon at the top level
+	valueFrom  int  // -1 until the value's first character
+	inArray    bool // the value is an array
+	itemFrom   int  // -1 while no array element is being read
+	done       bool
+}
+
+func (s *sectionStream) write(delta string) {
+	s.buf = append(s.buf, delta...)
+	for ; s.pos < len(s.buf) && !s.done; s.pos++ {
+		s.scan(s.pos, s.buf[s.pos])
+	}
+}
+
+func (s *sectionStream) scan(i int, ch byte) {
+	if s.inString {
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case ch == '\\':
+			s.escaped = true
+		case ch == '"':
+			s.inString = false
+			if s.depth == 1 && !s.inValue {
+				s.key = string(s.buf[s.stringFrom+1 : i])
+			}
+		}
+		return
+	}
+	if s.depth == 0 {
+		if ch == '{' {
+			s.depth = 1
+		}
+		return
+	}
+
+	isSpace := ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t'
+	if s.depth == 1 && s.inValue && s.valueFrom < 0 && !isSpace {
+		s.valueFrom = i
+		s.inArray = ch == '['
+		s.itemFrom = -1
+	}
+	if s.depth == 2 && s.inArray && s.itemFrom < 0 && !isSpace && ch != ',' && ch != ']' {
+		s.itemFrom = i
+	}
+
+	switch ch {
+	case '"':
+		s.inString, s.stringFrom = true, i
+	case ':':
+		if s.depth == 1 && !s.inValue {
+			s.inValue, s.valueFrom = true, -1
+		}
+	case '{', '[':
+		s.depth++
+	case ',':
+		switch {
+		case s.depth == 2 && s.inArray:
+			s.endItem(i)
+		case s.depth == 1 && s.inValue:
+			s.endValue(i)
+		}
+	case ']', '}':
+		if s.depth == 2 && s.inArray && ch == ']' {
+			s.endItem(i)
+		}
+		s.depth--
+		if s.depth == 0 {
+			if s.inValue {
+				s.endValue(i)
+			}
+			s.done = true
+		}
+	}
+}
+
+func (s *sectionStream) endItem(i int) {
+	if s.itemFrom >= 0 {
+		s.onSection(s.key, json.RawMessage(strings.TrimSpace(string(s.buf[s.itemFrom:i]))))
+	}
+	s.itemFrom = -1
+}
+
+func (s *sectionStream) endValue(i int) {
+	if !s.inArray && s.valueFrom >= 0 {
+		s.onSection(s.key, json.RawMessage(strings.TrimSpace(string(s.buf[s.valueFrom:i]))))
+	}
+	s.inValue, s.inArray = false, false
+}
+
+// parseStructuredRecommendation decodes the model's output and lists what
+// doesn't match the schema. Text around the JSON object, such as a Markdown
+// code fence, is ignored.
+func parseStructuredRecommendation(content string) (StructuredRecommendation, []string) {
+	var structured StructuredRecommendation
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return structured, []string{"the response did not contain a JSON object"}
+	}
+	if err := json.Unmarshal([]byte(content[start:end+1]), &structured); err != nil {
+		return structured, []string{"the response was not valid JSON: " + err.Error()}
+	}
+	structured.Guidance, structured.Notices = "", nil
+	structured.Severity = strings.ToLower(strings.TrimSpace(structured.Severity))
+	return structured, validateStructuredRecommendation(structured)
+}
+
+// validateStructuredRecommendation lists everything that makes a
+// recommendation unusable
+func validateStructuredRecommendation(structured StructuredRecommendation) []string {
+	problems := []string{}
+	if strings.TrimSpace(structured.Assessment) == "" {
+		problems = append(problems, "assessment is missing")
+	}
+	if !recommendationSeverities[structured.Severity] {
+		problems = append(problems, fmt.Sprintf("severity must be normal, attention or urgent, got %q", structured.Severity))
+	}
+	if len(structured.Meals) < 1 || len(structured.Meals) > 4 {
+		problems = append(problems, fmt.Sprintf("meals must have 1 to 4 entries, got %d", len(structured.Meals)))
+	}
+	for i, meal := range structured.Meals {
+		if strings.TrimSpace(meal.Name) == "" || strings.TrimSpace(meal.Reasoning) == "" {
+			problems = append(problems, fmt.Sprintf("meal %d needs a name and a reasoning", i+1))
+		}
+		if meal.Carbs < 0 || meal.Carbs > 200 {
+			problems = append(problems, fmt.Sprintf("meal %d has %.0f g carbs, expected 0 to 200", i+1, meal.Carbs))
+		}
+	}
+	if len(structured.Activities) > 3 {
+		problems = append(problems, fmt.Sprintf("activities must have at most 3 entries, got %d", len(structured.Activities)))
+	}
+	for i, activity := range structured.Activities {
+		if strings.TrimSpace(activity.Type) == "" || strings.TrimSpace(activity.Timing) == "" {
+			problems = append(problems, fmt.Sprintf("activity %d needs a type and a timing", i+1))
+		}
+		if activity.DurationMinutes < 1 || activity.DurationMinutes > 180 {
+			problems = append(problems, fmt.Sprintf("activity %d lasts %d minutes, expected 1 to 180", i+1, activity.DurationMinutes))
+		}
+	}
+	if len(structured.FollowUp) < 1 || len(structured.FollowUp) > 3 {
+		problems = append(problems, fmt.Sprintf("follow_up must have 1 to 3 entries, got %d", len(structured.FollowUp)))
+	}
+	for i, check := range structured.FollowUp {
+		if strings.TrimSpace(check) == "" {
+			problems = append(problems, fmt.Sprintf("follow_up %d is empty", i+1))
+		}
+	}
+	return problems
+}
+
+// renderRecommendation is the text version of a structured recommendation
+func renderRecommendation(structured StructuredRecommendation) string {
+	var sb strings.Builder
+	if structured.Guidance != "" {
+		sb.WriteString(structured.Guidance + "\n\n")
+	}
+	sb.WriteString(structured.Assessment)
+	if len(structured.Meals) > 0 {
+		sb.WriteString("\n\nMeals for the rest of today:")
+		for _, meal := range structured.Meals {
+			sb.WriteString(fmt.Sprintf("\n- %s (about %.0f g carbohydrates)", meal.Name, meal.Carbs))
+			if meal.Reasoning != "" {
+				sb.WriteString(": " + meal.Reasoning)
+			}
+		}
+	}
+	if len(structured.Activities) > 0 {
+		sb.WriteString("\n\nActivity:")
+		for _, activity := range structured.Activities {
+			sb.WriteString(fmt.Sprintf("\n- %s for %d minutes, %s", activity.Type, activity.DurationMinutes, activity.Timing))
+		}
+	}
+	if len(structured.FollowUp) > 0 {
+		sb.WriteString("\n\nFollow-up:")
+		for _, check := range structured.FollowUp {
+			sb.WriteString("\n- " + check)
+		}
+	}
+	for _, notice := range structured.Notices {
+		sb.WriteString("\n\n" + notice)
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Meals eaten between lateNightStart and lateNightEnd (local hours) count as
+// late-night eating
+const (
+	lateNightStart = 22
+	lateNightEnd   = 5
+)
+
+var mealTypes = []string{"breakfast", "lunch", "dinner", "snack"}
+
+// NutritionTotals are the intake figures shared by summaries
+type NutritionTotals struct {
+	Calories     float64 `json:"calories"`
+	Carbs        float64 `json:"carbs"`
+	Protein      float64 `json:"protein"`
+	Fat          float64 `json:"fat"`
+	Fiber        float64 `json:"fiber"`
+	Sugar        float64 `json:"sugar"`
+	GlycemicLoad float64 `json:"glycemic_load"`
+}
+
+func (t *NutritionTotals) add(meal DietLog) {
+	nutrients := parseNutrients(meal.Nutrients)
+	t.Calories += float64(meal.Calories)
+	t.Carbs += mealCarbs(meal)
+	t.Protein += nutrientValue(nutrients, proteinKeys...)
+	t.Fat += nutrientValue(nutrients, fatKeys...)
+	t.Fiber += nutrientValue(nutrients, fiberKeys...)
+	t.Sugar += nutrientValue(nutrients, sugarKeys...)
+	t.GlycemicLoad += meal.GlycemicLoad
+}
+
+func (t NutritionTotals) scaled(factor float64) NutritionTotals {
+	return NutritionTotals{
+		Calories:     round1(t.Calories * factor),
+		Carbs:        round1(t.Carbs * factor),
+		Protein:      round1(t.Protein * factor),
+		Fat:          round1(t.Fat * factor),
+		Fiber:        round1(t.Fiber * factor),
+		Sugar:        round1(t.Sugar * factor),
+		GlycemicLoad: round1(t.GlycemicLoad * factor),
+	}
+}
+
+// NutritionPeriod is one day or week of a nutrition summary
+type NutritionPeriod struct {
+	Start           string             `json:"start"`
+	End             string             `json:"end"`
+	Totals          NutritionTotals    `json:"totals"`
+	Meals           int                `json:"meals"`
+	LateNightMeals  int                `json:"late_night_meals"`
+	LoggedDays      int                `json:"logged_days"`
+	CarbsByMealType map[string]float64 `json:"carbs_by_meal_type"`
+	MealsByMealType map[string]int     `json:"meals_by_meal_type"`
+	Fluids          FluidTotals        `json:"fluids"`
+	loggedDates     map[string]bool
+}
+
+// GET /diet/summary?period=day|week&from=YYYY-MM-DD&to=YYYY-MM-DD&tz=Area/City
+func GetNutritionSummary(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	period := c.DefaultQuery("period", "day")
+	if period != "day" && period != "week" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day or week"})
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	defaultDays := 7
+	if period == "week" {
+		defaultDays = 28
+	}
+	from, to, err := requestDateRange(c, loc, defaultDays)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if period == "week" {
+		// Weeks run Monday to Sunday
+		from = from.AddDate(0, 0, -((int(from.Weekday()) + 6) % 7))
+	}
+
+	var logs []DietLog
+	if err := DB.Where("user_id = ? AND timestamp >= ? AND timestamp < ?", userID.(uint), from, to).
+		Order("timestamp").Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve diet logs"})
+		return
+	}
+
+	var fluids []FluidIntake
+	if err := DB.Where("user_id = ? AND recorded_at >= ? AND recorded_at < ?", userID.(uint), from, to).
+		Order("recorded_at").Find(&fluids).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve fluid intake"})
+		return
+	}
+
+	// Build the empty buckets first so days without meals still show up
+	var periods []*NutritionPeriod
+	for start := from; start.Before(to); {
+		end := start.AddDate(0, 0, 1)
+		if period == "week" {
+			end = start.AddDate(0, 0, 7)
+		}
+		last := end.AddDate(0, 0, -1)
+		if end.After(to) {
+			last = to.AddDate(0, 0, -1)
+		}
+		periods = append(periods, &NutritionPeriod{
+			Start:           start.Format("2006-01-02"),
+			End:             last.Format("2006-01-02"),
+			CarbsByMealType: map[string]float64{},
+			MealsByMealType: map[string]int{},
+			loggedDates:     map[string]bool{},
+		})
+		start = end
+	}
+
+	var overall NutritionTotals
+	loggedDays := map[string]bool{}
+	lateNight := 0
+	for _, meal := range logs {
+		local := meal.Timestamp.In(loc)
+		date := local.Format("2006-01-02")
+		bucket := periodFor(periods, date)
+
+		mealType := meal.MealType
+		if mealType == "" {
+			mealType = inferMealType(local)
+		}
+
+		bucket.Totals.add(meal)
+		bucket.Meals++
+		bucket.CarbsByMealType[mealType] += mealCarbs(meal)
+		bucket.MealsByMealType[mealType]++
+		bucket.loggedDates[date] = true
+		if isLateNight(local) {
+			bucket.LateNightMeals++
+			lateNight++
+		}
+
+		overall.add(meal)
+		loggedDays[date] = true
+	}
+
+	// Drinks count towards intake: their carbs and calories are part of the
+	// totals, the volumes and alcohol are reported separately
+	var overallFluids FluidTotals
+	for _, intake := range fluids {
+		local := intake.RecordedAt.In(loc)
+		date := local.Format("2006-01-02")
+		bucket := periodFor(periods, date)
+		bucket.Fluids.add(intake)
+		bucket.Totals.Calories += intake.Calories
+		bucket.Totals.Carbs += intake.Carbs
+		bucket.loggedDates[date] = true
+		overallFluids.add(intake)
+		overall.Calories += intake.Calories
+		overall.Carbs += intake.Carbs
+		loggedDays[date] = true
+	}
+
+	results := make([]NutritionPeriod, 0, len(periods))
+	for _, p := range periods {
+		p.Totals = p.Totals.scaled(1)
+		p.Fluids = p.Fluids.rounded()
+		p.LoggedDays = len(p.loggedDates)
+		for mealType, carbs := range p.CarbsByMealType {
+			p.CarbsByMealType[mealType] = round1(carbs)
+		}
+		results = append(results, *p)
+	}
+
+	// Averages are per logged day, so days the user forgot to log don't drag them down
+	var average NutritionTotals
+	if len(loggedDays) > 0 {
+		average = overall.scaled(1 / float64(len(loggedDays)))
+	}
+
+	var medicalProfile MedicalProfile
+	targets := gin.H{}
+	versusTarget := gin.H{}
+	if err := DB.Where("user_id = ?", userID.(uint)).First(&medicalProfile).Error; err == nil {
+		if medicalProfile.DailyCalorieTarget > 0 {
+			targets["daily_calories"] = medicalProfile.DailyCalorieTarget
+			versusTarget["calories_percent"] = round1(average.Calories / medicalProfile.DailyCalorieTarget * 100)
+		}
+		if medicalProfile.DailyCarbTarget > 0 {
+			targets["daily_carbs"] = medicalProfile.DailyCarbTarget
+			versusTarget["carbs_percent"] = round1(average.Carbs / medicalProfile.DailyCarbTarget * 100)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":           period,
+		"timezone":         loc.String(),
+		"from":             from.Format("2006-01-02"),
+		"to":               to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"periods":          results,
+		"totals":           overall.scaled(1),
+		"fluids":           overallFluids.rounded(),
+		"meals":            len(logs),
+		"late_night_meals": lateNight,
+		"logged_days":      len(loggedDays),
+		"daily_average":    average,
+		"targets":          targets,
+		"versus_target":    versusTarget,
+	})
+}
+
+// periodFor returns the bucket containing the local date
+func periodFor(periods []*NutritionPeriod, date string) *NutritionPeriod {
+	for _, p := range periods {
+		if date >= p.Start && date <= p.End {
+			return p
+		}
+	}
+	return periods[0]
+}
+
+// mealCarbs prefers the stored carbohydrate total and falls back to the
+// nutrients of entries logged before it was recorded
+func mealCarbs(meal DietLog) float64 {
+	if meal.Carbs > 0 {
+		return meal.Carbs
+	}
+	return nutrientValue(parseNutrients(meal.Nutrients), carbohydrateKeys...)
+}
+
+// requestLocation reads the tz query parameter (an IANA zone name), UTC by default
+func requestLocation(c *gin.Context) (*time.Location, error) {
+	name := c.Query("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// requestDateRange parses the inclusive from/to dates (YYYY-MM-DD) in loc and
+// returns [from midnight, day after to midnight). Without parameters the range
+// is the last defaultDays days including today.
+func requestDateRange(c *gin.Context, loc *time.Location, defaultDays int) (time.Time, time.Time, error) {
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if v := c.Query("to"); v != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date (expected YYYY-MM-DD)")
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -(defaultDays - 1))
+	if v := c.Query("from"); v != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date (expected YYYY-MM-DD)")
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("date range cannot exceed one year")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// inferMealType guesses the meal from the local time it was eaten
+func inferMealType(local time.Time) string {
+	switch hour := local.Hour(); {
+	case hour >= 5 && hour < 11:
+		return "breakfast"
+	case hour >= 11 && hour < 16:
+		return "lunch"
+	case hour >= 16 && hour < 22:
+		return "dinner"
+	default:
+		return "snack"
+	}
+}
+
+func isLateNight(local time.Time) bool {
+	return local.Hour() >= lateNightStart || local.Hour() < lateNightEnd
+}
+
+// normalizeMealType lower-cases a client supplied meal type, empty is allowed
+func normalizeMealType(mealType string) (string, error) {
+	mealType = strings.ToLower(strings.TrimSpace(mealType))
+	if mealType == "" {
+		return "", nil
+	}
+	for _, known := range mealTypes {
+		if mealType == known {
+			return mealType, nil
+		}
+	}
+	return "", fmt.Errorf("meal_type must be one of %s", strings.Join(mealTypes, ", "))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxTagLength = 50
+
+// Tag is a user-defined label such as "exercise" or "sick day"
+type Tag struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"not null;uniqueIndex:idx_tag_user_name" json:"user_id"`
+	Name   string `gorm:"not null;uniqueIndex:idx_tag_user_name" json:"name"`
+	Count  int64  `gorm:"-" json:"count"`
+}
+
+// EntryTag attaches a tag to a timeline entry. EntryType is the timeline
+// event type (glucose, meal, fluid, medication, appointment or note).
+type EntryTag struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	TagID     uint   `gorm:"not null;uniqueIndex:idx_entry_tag" json:"tag_id"`
+	EntryType string `gorm:"not null;uniqueIndex:idx_entry_tag;index:idx_entry_tag_entry" json:"entry_type"`
+	EntryID   uint   `gorm:"not null;uniqueIndex:idx_entry_tag;index:idx_entry_tag_entry" json:"entry_id"`
+}
+
+// normalizeTag lower-cases and trims a tag name
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// GET /tags
+// Lists the user's tags with how many entries use them.
+func GetTags(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var tags []Tag
+	err := DB.Table("tags").
+		Select("tags.id, tags.user_id, tags.name, COUNT(entry_tags.id) AS count").
+		Joins("LEFT JOIN entry_tags ON entry_tags.tag_id = tags.id").
+		Where("tags.user_id = ?", userID.(uint)).
+		Group("tags.id").
+		Order("count desc, tags.name").
+		Scan(&tags).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// POST /entries/:type/:id/tags
+// Body: {"tags": ["exercise", "sick day"]}. New tag names are created.
+func AddEntryTags(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	source, entryID, ok := findTaggableEntry(c, userID.(uint))
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Tags []string `json:"tags" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var names []string
+	for _, name := range input.Tags {
+		name = normalizeTag(name)
+		if name == "" || len(name) > maxTagLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Tags must be between 1 and %d characters", maxTagLength)})
+			return
+		}
+		names = append(names, name)
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, name := range names {
+			tag := Tag{UserID: userID.(uint), Name: name}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&tag).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ? AND name = ?", tag.UserID, name).First(&tag).Error; err != nil {
+				return err
+			}
+			link := EntryTag{TagID: tag.ID, EntryType: source.eventType, EntryID: entryID}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tags saved", "tags": entryTags(userID.(uint), source.eventType, entryID)})
+}
+
+// DELETE /entries/:type/:id/tags/:tag
+func DeleteEntryTag(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	source, entryID, ok := findTaggableEntry(c, userID.(uint))
+	if !ok {
+		return
+	}
+
+	result := DB.Where("entry_type = ? AND entry_id = ? AND tag_id IN (?)", source.eventType, entryID,
+		DB.Model(&Tag{}).Select("id").Where("user_id = ? AND name = ?", userID.(uint), normalizeTag(c.Param("tag")))).
+		Delete(&EntryTag{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove tag"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found on this entry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tag removed", "tags": entryTags(userID.(uint), source.eventType, entryID)})
+}
+
+// findTaggableEntry resolves the :type and :id parameters to an entry owned by
+// the user, writing the error response when there is none
+func findTaggableEntry(c *gin.Context, userID uint) (timelineSource, uint, bool) {
+	source, ok := findTimelineSource(c.Param("type"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown entry type"})
+		return source, 0, false
+	}
+
+	var entryID uint
+	if _, err := fmt.Sscan(c.Param("id"), &entryID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entry ID"})
+		return source, 0, false
+	}
+
+	var count int64
+	DB.Model(source.model).Where("id = ? AND user_id = ?", entryID, userID).Count(&count)
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+		return source, 0, false
+	}
+	return source, entryID, true
+}
+
+// entryTags returns the tag names of one entry
+func entryTags(userID uint, entryType string, entryID uint) []string {
+	names := []string{}
+	DB.Table("entry_tags").Select("tags.name").
+		Joins("JOIN tags ON tags.id = entry_tags.tag_id").
+		Where("tags.user_id = ? AND entry_tags.entry_type = ? AND entry_tags.entry_id = ?", userID, entryType, entryID).
+		Order("tags.name").Pluck("tags.name", &names)
+	return names
+}
+
+// attachTags fills in the tags of a page of timeline events with one query
+func attachTags(userID uint, events []TimelineEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := map[string][]uint{}
+	for _, event := range events {
+		ids[event.Type] = append(ids[event.Type], event.ID)
+	}
+	query := DB.Table("entry_tags").Select("entry_tags.entry_type, entry_tags.entry_id, tags.name").
+		Joins("JOIN tags ON tags.id = entry_tags.tag_id").
+		Where("tags.user_id = ?", userID)
+	conditions := DB.Where("1 = 0")
+	for eventType, entryIDs := range ids {
+		conditions = conditions.Or("entry_tags.entry_type = ? AND entry_tags.entry_id IN ?", eventType, entryIDs)
+	}
+
+	var rows []struct {
+		EntryType string
+		EntryID   uint
+		Name      string
+	}
+	if err := query.Where(conditions).Order("tags.name").Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	tags := map[string][]string{}
+	for _, row := range rows {
+		key := fmt.Sprintf("%s:%d", row.EntryType, row.EntryID)
+		tags[key] = append(tags[key], row.Name)
+	}
+	for i := range events {
+		events[i].Tags = tags[fmt.Sprintf("%s:%d", events[i].Type, events[i].ID)]
+		if events[i].Tags == nil {
+			events[i].Tags = []string{}
+		}
+	}
+	return nil
+}
+
+// createSearchIndexes adds the GIN indexes backing the full-text search. The
+// indexed expressions must match timelineFilter.scope exactly.
+func createSearchIndexes() {
+	for _, source := range timelineSources {
+		sql := fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_search ON %s USING GIN (to_tsvector('english', %s))",
+			source.table, source.table, source.text)
+		if err := DB.Exec(sql).Error; err != nil {
+			fmt.Println("Failed to create search index:", err)
+		}
+	}
+}
@@ -90,11 +90,23 @@ class _HistoryScreenState extends State<HistoryScreen> {
     return '';
   }
 
+  // Helper method to show an event timestamp in local time
+  String formatTimestamp(String? timestamp) {
+    final parsed = DateTime.tryParse(timestamp ?? '');
+    if (parsed == null) {
+      return '';
+    }
+    final local = parsed.toLocal();
+    String twoDigits(int n) => n.toString().padLeft(2, '0');
+    return "${local.year}-${twoDigits(local.month)}-${twoDigits(local.day)} "
+        "${twoDigits(local.hour)}:${twoDigits(local.minute)}";
+  }
+
   @override
   Widget build(BuildContext context) {
     return Scaffold(
       appBar: AppBar(
-        title: const Text("Diet + Glucose History"),
+        title: const Text("History"),
         actions: [
           IconButton(
             icon: const Icon(Icons.logout),
@@ -112,7 +124,9 @@ class _HistoryScreenState extends State<HistoryScreen> {
               : ListView.builder(
                   itemCount: history.length,
                   itemBuilder: (context, index) {
-                    final entry = history[index];
+                    final event = history[index];
+                    final type = event['type'];
+                    final entry = event['data'] ?? {};
                     final nutrientsMap = parseNutrients(entry['nutrients'] ?? '');
                     final isExpanded = expandedItems[index] ?? false;
                     
@@ -129,9 +143,10 @@ class _HistoryScreenState extends State<HistoryScreen> {
                         child: Column(
                           crossAxisAlignment: CrossAxisAlignment.start,
                           children: [
-                            Text("📅 ${entry['timestamp']}", 
+                            Text("📅 ${formatTimestamp(event['timestamp'])}", 
                                 style: const TextStyle(fontWeight: FontWeight.bold)),
                             const SizedBox(height: 8),
+                            if (type == 'meal') ...[
                             Text("🍽 Food: ${entry['food_description']}"),
                             Text("🔥 Calories: ${entry['calories']}"),
                             
@@ -218,12 +233,22 @@ class _HistoryScreenState extends State<HistoryScreen> {
                                 ),
                             ] else
                               const Text("🔬 Nutrients: Not available"),
-                            
-                            const SizedBox(height: 8),
-                            Text("💉 Glucose: ${entry['glucose_level']} mg/dL"),
-                            Text("🕒 Meal Tag: ${entry['meal_tag']}"),
-                            Text("📌 Meal Type: ${entry['meal_type']}"),
-                            Text("📝 Notes: ${entry['notes']}"),
+                            ],
+
+                            if (type == 'glucose') ...[
+                              Text("💉 Glucose: ${entry['level']} mg/dL"),
+                              Text("🕒 Meal Tag: ${entry['meal_tag']}"),
+                              Text("📌 Meal Type: ${entry['meal_type']}"),
+                              Text("📝 Notes: ${entry['notes']}"),
+                            ],
+                            if (type == 'fluid')
+                              Text("🥤 ${entry['beverage_type']}: ${entry['volume_ml']} ml"),
+                            if (type == 'medication')
+                              Text("💊 ${entry['Name']} ${entry['Dosage'] ?? ''}"),
+                            if (type == 'appointment')
+                              Text("🩺 ${entry['Purpose']} with ${entry['PhysicianName']}"),
+                            if (type == 'note')
+                              Text("📝 ${entry['text']}"),
                           ],
                         ),
                       ),